@@ -0,0 +1,416 @@
+package webext
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// ACME challenge types supported by ACMEOpts.Challenges
+const (
+	ACMEChallengeHTTP01 string = "http-01"
+	ACMEChallengeTLSALPN01 string = "tls-alpn-01"
+)
+
+// ACMEOpts contains the settings for issuing certificates from an ACME certificate authority (like Let's Encrypt)
+type ACMEOpts struct {
+	// Domains is the list of domains the certificate is issued for.
+	// Every domain must point to this server, so the ACME server can verify it.
+	Domains []string
+
+	// Email is an optional contact address for the ACME account
+	Email string
+
+	// DirectoryURL is the url of the ACME directory.
+	// You can set this to a local Pebble server for testing.
+	//
+	// default: Let's Encrypt production (acme.LetsEncryptURL)
+	DirectoryURL string
+
+	// Challenges is the list of challenge types that are allowed, in order of preference
+	//  - ACMEChallengeHTTP01 // served on the http port at /.well-known/acme-challenge/
+	//  - ACMEChallengeTLSALPN01 // served on the https port
+	//
+	// Note: ACME servers verify these challenges on port 80 and 443.
+	//
+	// default: both
+	Challenges []string
+
+	// HTTPClient is used to talk to the ACME server.
+	// You can set this to trust the root certificate of a local Pebble server.
+	//
+	// default: http.DefaultClient
+	HTTPClient *http.Client
+
+	// RenewBefore is how long before the certificate expires it should be renewed
+	//
+	// default: 30 days
+	RenewBefore time.Duration
+}
+
+var acmeOpts *ACMEOpts
+var acmeMU sync.RWMutex
+
+// acmeHTTPTokens contains the responses to pending http-01 challenges, by token
+var acmeHTTPTokens map[string]string = map[string]string{}
+
+// acmeALPNCerts contains the certificates for pending tls-alpn-01 challenges, by domain
+var acmeALPNCerts map[string]*tls.Certificate = map[string]*tls.Certificate{}
+
+// acmeApps contains the apps that already have a handler for http-01 challenges
+var acmeApps sync.Map
+
+// SetACME enables issuing certificates from an ACME server in ListenAutoTLS.
+// Set it to nil to disable it (default).
+//
+// If the certificate cannot be issued, ListenAutoTLS falls back to a self signed certificate,
+// and tries again on the next renewal.
+//
+// http-01 challenges are served by VerifyOrigin and RedirectSSL.
+// If you use neither, ListenAutoTLS adds a handler after your routes,
+// which a catch-all route (i.e. a 404 page) would hide from the ACME server.
+//
+//  webext.SetACME(&webext.ACMEOpts{
+//    Domains: []string{"example.com", "www.example.com"},
+//    Email: "admin@example.com",
+//  })
+func SetACME(opts *ACMEOpts) {
+	acmeMU.Lock()
+	defer acmeMU.Unlock()
+
+	if opts != nil {
+		o := *opts
+		if o.DirectoryURL == "" {
+			o.DirectoryURL = acme.LetsEncryptURL
+		}
+		if len(o.Challenges) == 0 {
+			o.Challenges = []string{ACMEChallengeTLSALPN01, ACMEChallengeHTTP01}
+		}
+		if o.RenewBefore <= 0 {
+			o.RenewBefore = 30 * 24 * time.Hour
+		}
+		opts = &o
+	}
+
+	acmeOpts = opts
+}
+
+// getACME returns the current ACME settings, or nil if ACME is disabled
+func getACME() *ACMEOpts {
+	acmeMU.RLock()
+	defer acmeMU.RUnlock()
+	return acmeOpts
+}
+
+// acmeHTTPChallenge returns the response to a pending http-01 challenge
+//
+// @path: the path of the request
+func acmeHTTPChallenge(path string) (string, bool) {
+	token, ok := strings.CutPrefix(path, "/.well-known/acme-challenge/")
+	if !ok {
+		return "", false
+	}
+
+	acmeMU.RLock()
+	defer acmeMU.RUnlock()
+
+	res, ok := acmeHTTPTokens[token]
+	return res, ok
+}
+
+// acmeALPNCert returns the certificate for a pending tls-alpn-01 challenge,
+// if the client is an ACME server verifying one
+func acmeALPNCert(hello *tls.ClientHelloInfo) (*tls.Certificate, bool) {
+	if len(hello.SupportedProtos) != 1 || hello.SupportedProtos[0] != acme.ALPNProto {
+		return nil, false
+	}
+
+	acmeMU.RLock()
+	defer acmeMU.RUnlock()
+
+	cert, ok := acmeALPNCerts[hello.ServerName]
+	return cert, ok
+}
+
+// acmeCertIfNeeded issues a new certificate from the ACME server if
+// the current one is missing, expiring, self signed, or not valid for all of the domains
+func acmeCertIfNeeded(ctx context.Context, opts *ACMEOpts, crtPath string, keyPath string) error {
+	if err := checkKeyPassphrase(keyPath); err != nil {
+		return err
+	}
+
+	if leaf, err := loadCertLeaf(crtPath, keyPath); err == nil {
+		valid := clockNow().Add(opts.RenewBefore).Before(leaf.NotAfter) && !isSelfSigned(leaf)
+		for _, domain := range opts.Domains {
+			if leaf.VerifyHostname(domain) != nil {
+				valid = false
+				break
+			}
+		}
+
+		if valid {
+			return nil
+		}
+	}
+
+	return acmeIssue(ctx, opts, crtPath, keyPath)
+}
+
+// renewACME issues or renews the certificate used by ListenAutoTLS
+//
+// if the ACME server fails, a self signed certificate is generated,
+// unless the current certificate has not expired yet
+func renewACME(ctx context.Context, opts *ACMEOpts, crtPath string, keyPath string) error {
+	// only one instance requests a certificate that is shared by multiple instances
+	err := withCertLock(crtPath, func() error {
+		return acmeCertIfNeeded(ctx, opts, crtPath, keyPath)
+	})
+	if err != nil {
+		if e := genRsaKeyIfExpired(crtPath, keyPath); e != nil {
+			return e
+		}
+	}
+	return err
+}
+
+// acmeTLSConfig adds the certificates of pending tls-alpn-01 challenges to a tls config
+func acmeTLSConfig(config *tls.Config) {
+	getCert := config.GetCertificate
+
+	config.NextProtos = append(config.NextProtos, acme.ALPNProto)
+	config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if cert, ok := acmeALPNCert(hello); ok {
+			return cert, nil
+		}
+		return getCert(hello)
+	}
+}
+
+// acmeIssue issues a new certificate from the ACME server, and writes it to @crtPath and @keyPath
+func acmeIssue(ctx context.Context, opts *ACMEOpts, crtPath string, keyPath string) error {
+	if len(opts.Domains) == 0 {
+		return errors.New("acme: no domains")
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, 5 * time.Minute)
+		defer cancel()
+	}
+
+	PrintMsg(`warn`, "Requesting New SSL Certificate...", 50, false)
+
+	accountKey, err := acmeAccountKey(strings.TrimSuffix(keyPath, ".key")+".account.key")
+	if err != nil {
+		PrintMsg(`error`, "Error: Failed To Request SSL Certificate!", 50, true)
+		return err
+	}
+
+	client := &acme.Client{
+		Key: accountKey,
+		DirectoryURL: opts.DirectoryURL,
+		HTTPClient: opts.HTTPClient,
+	}
+
+	account := &acme.Account{}
+	if opts.Email != "" {
+		account.Contact = []string{"mailto:"+opts.Email}
+	}
+
+	if _, err := client.Register(ctx, account, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		PrintMsg(`error`, "Error: Failed To Request SSL Certificate!", 50, true)
+		return err
+	}
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(opts.Domains...))
+	if err != nil {
+		PrintMsg(`error`, "Error: Failed To Request SSL Certificate!", 50, true)
+		return err
+	}
+
+	for _, authzURL := range order.AuthzURLs {
+		if err := acmeAuthorize(ctx, client, opts, authzURL); err != nil {
+			PrintMsg(`error`, "Error: Failed To Request SSL Certificate!", 50, true)
+			return err
+		}
+	}
+
+	order, err = client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		PrintMsg(`error`, "Error: Failed To Request SSL Certificate!", 50, true)
+		return err
+	}
+
+	// generate the certificate key and signing request
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		PrintMsg(`error`, "Error: Failed To Request SSL Certificate!", 50, true)
+		return err
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: opts.Domains[0]},
+		DNSNames: opts.Domains,
+	}, key)
+	if err != nil {
+		PrintMsg(`error`, "Error: Failed To Request SSL Certificate!", 50, true)
+		return err
+	}
+
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		PrintMsg(`error`, "Error: Failed To Request SSL Certificate!", 50, true)
+		return err
+	}
+
+	// pem encoding of the certificate chain and key
+	certPem := []byte{}
+	for _, der := range chain {
+		certPem = append(certPem, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+
+	keyPEM, err := marshalKeyPEM(key)
+	if err != nil {
+		PrintMsg(`error`, "Error: Failed To Request SSL Certificate!", 50, true)
+		return err
+	}
+
+	// keep the current pair, so it can be restored (see RollbackCert)
+	if err := keepCertHistory(crtPath, keyPath); err != nil {
+		PrintMsg(`error`, "Error: Failed To Request SSL Certificate!", 50, true)
+		return err
+	}
+
+	if err := writeCertFiles(crtPath, keyPath, certPem, keyPEM); err != nil {
+		PrintMsg(`error`, "Error: Failed To Request SSL Certificate!", 50, true)
+		return err
+	}
+
+	PrintMsg(`warn`, "New SSL Certificate Issued!", 50, true)
+
+	return nil
+}
+
+// acmeAuthorize completes one of the allowed challenges for an authorization
+func acmeAuthorize(ctx context.Context, client *acme.Client, opts *ACMEOpts, authzURL string) error {
+	authz, err := client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return err
+	}
+
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+
+	// pick the first allowed challenge offered by the server
+	var chal *acme.Challenge
+	for _, typ := range opts.Challenges {
+		for _, c := range authz.Challenges {
+			if c.Type == typ {
+				chal = c
+				break
+			}
+		}
+		if chal != nil {
+			break
+		}
+	}
+
+	if chal == nil {
+		return errors.New("acme: no supported challenge for "+authz.Identifier.Value)
+	}
+
+	switch chal.Type {
+	case ACMEChallengeHTTP01:
+		res, err := client.HTTP01ChallengeResponse(chal.Token)
+		if err != nil {
+			return err
+		}
+
+		acmeMU.Lock()
+		acmeHTTPTokens[chal.Token] = res
+		acmeMU.Unlock()
+
+		defer func(){
+			acmeMU.Lock()
+			delete(acmeHTTPTokens, chal.Token)
+			acmeMU.Unlock()
+		}()
+	case ACMEChallengeTLSALPN01:
+		cert, err := client.TLSALPN01ChallengeCert(chal.Token, authz.Identifier.Value)
+		if err != nil {
+			return err
+		}
+
+		acmeMU.Lock()
+		acmeALPNCerts[authz.Identifier.Value] = &cert
+		acmeMU.Unlock()
+
+		defer func(){
+			acmeMU.Lock()
+			delete(acmeALPNCerts, authz.Identifier.Value)
+			acmeMU.Unlock()
+		}()
+	}
+
+	if _, err := client.Accept(ctx, chal); err != nil {
+		return err
+	}
+
+	_, err = client.WaitAuthorization(ctx, authz.URI)
+	return err
+}
+
+// loadCertLeaf loads a certificate and key pair, and returns the parsed certificate
+func loadCertLeaf(crtPath string, keyPath string) (*x509.Certificate, error) {
+	cert, err := loadKeyPair(crtPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(cert.Certificate[0])
+}
+
+// isSelfSigned returns true if a certificate was signed by its own key
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature) == nil
+}
+
+// acmeAccountKey loads the ACME account key, or generates a new one if it does not exist
+func acmeAccountKey(path string) (crypto.Signer, error) {
+	if buf, err := os.ReadFile(path); err == nil {
+		return parseKeyPEM(buf)
+	}else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	keyPEM, err := marshalKeyPEM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeFileAtomic(path, keyPEM); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
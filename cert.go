@@ -0,0 +1,352 @@
+package webext
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+// CertRenewBefore is how long before a certificate expires it should be renewed by GenRsaKeyIfNeeded
+//
+// default: 30 days
+var CertRenewBefore time.Duration = 30 * 24 * time.Hour
+
+// CertKeyType is the type of private key generated by GenCert
+type CertKeyType uint8
+
+const (
+	// CertRSA4096 generates a 4096 bit RSA key (default)
+	CertRSA4096 CertKeyType = iota
+
+	// CertRSA2048 generates a 2048 bit RSA key
+	CertRSA2048
+
+	// CertRSA3072 generates a 3072 bit RSA key
+	CertRSA3072
+
+	// CertECDSAP256 generates an ECDSA key on the P-256 curve
+	CertECDSAP256
+
+	// CertECDSAP384 generates an ECDSA key on the P-384 curve
+	CertECDSAP384
+
+	// CertEd25519 generates an Ed25519 key
+	//
+	// Note: some older clients do not support Ed25519 certificates
+	CertEd25519
+)
+
+// CertOptions contains the settings for a certificate generated by GenCert
+type CertOptions struct {
+	// CrtPath is the file path to write the certificate to
+	CrtPath string
+
+	// KeyPath is the file path to write the private key to
+	KeyPath string
+
+	// CommonName is the subject name of the certificate
+	//
+	// default: the first DNS name, or "localhost"
+	CommonName string
+
+	// DNSNames is the list of domains the certificate is valid for
+	//
+	// default: localhost (if IPAddresses is also empty)
+	DNSNames []string
+
+	// IPAddresses is the list of ip addresses the certificate is valid for
+	//
+	// default: 127.0.0.1 and ::1 (if DNSNames is also empty)
+	IPAddresses []net.IP
+
+	// Organization, OrganizationalUnit, Country, Province and Locality are optional subject fields
+	Organization []string
+	OrganizationalUnit []string
+	Country []string
+	Province []string
+	Locality []string
+
+	// Validity is how long the certificate is valid for
+	//
+	// default: 3 years
+	Validity time.Duration
+
+	// KeyType is the type of private key to generate
+	//
+	// default: CertRSA4096
+	KeyType CertKeyType
+}
+
+// GenCert generates a new self signed ssl certificate and key pair
+//
+//  webext.GenCert(webext.CertOptions{
+//    CrtPath: "db/ssl/auto_ssl.crt",
+//    KeyPath: "db/ssl/auto_ssl.key",
+//    DNSNames: []string{"example.com", "www.example.com"},
+//    KeyType: webext.CertECDSAP256,
+//  })
+func GenCert(opts CertOptions) error {
+	return withCertLock(opts.CrtPath, func() error {
+		return genSelfSignedCert(opts)
+	})
+}
+
+// genSelfSignedCert is the same as GenCert, without taking the lock of the certificate
+func genSelfSignedCert(opts CertOptions) error {
+	PrintMsg(`warn`, "Generating New SSL Certificate...", 50, false)
+
+	certPem, keyPEM, err := genCertPEM(opts, nil, nil)
+	if err != nil {
+		PrintMsg(`error`, "Error: Failed To Generate SSL Certificate!", 50, true)
+		return err
+	}
+
+	if err := writeCertFiles(opts.CrtPath, opts.KeyPath, certPem, keyPEM); err != nil {
+		PrintMsg(`error`, "Error: Failed To Generate SSL Certificate!", 50, true)
+		return err
+	}
+
+	PrintMsg(`warn`, "New SSL Certificate Generated!", 50, true)
+
+	return nil
+}
+
+// certNeedsRenewal checks if the certificate at @crtPath expires within CertRenewBefore,
+// or does not match the key at @keyPath
+//
+// @parsed: false if the certificate could not be parsed
+//
+// @err: the key is encrypted, and cannot be decrypted (see CertKeyPassphraseEnv)
+func certNeedsRenewal(crtPath string, keyPath string) (renew bool, parsed bool, err error) {
+	if err := checkKeyPassphrase(keyPath); err != nil {
+		return false, false, err
+	}
+
+	buf, err := os.ReadFile(crtPath)
+	if err != nil {
+		return false, false, nil
+	}
+
+	block, _ := pem.Decode(buf)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return false, false, nil
+	}
+
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return false, false, nil
+	}
+
+	// the key is missing, invalid, or belongs to a different certificate
+	if _, err := loadKeyPair(crtPath, keyPath); err != nil {
+		return true, true, nil
+	}
+
+	now := clockNow()
+	return now.Add(CertRenewBefore).After(leaf.NotAfter) || now.Before(leaf.NotBefore), true, nil
+}
+
+// genCertPEM generates a new certificate, and returns the pem encoded certificate and key
+//
+// the certificate is signed by @parent and @parentKey,
+// or self signed if @parent is nil
+func genCertPEM(opts CertOptions, parent *x509.Certificate, parentKey crypto.Signer) (certPem []byte, keyPEM []byte, err error) {
+	key, err := genCertKey(opts.KeyType)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyPEM, err = marshalKeyPEM(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template, err := certTemplate(opts, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if parent == nil {
+		parent = template
+		parentKey = key
+	}
+
+	// Create certificate using template
+	derBytes, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// pem encoding of certificate
+	certPem = pem.EncodeToMemory(
+		&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: derBytes,
+		},
+	)
+
+	return certPem, keyPEM, nil
+}
+
+// certTemplate creates a certificate template from @opts
+func certTemplate(opts CertOptions, key crypto.Signer) (*x509.Certificate, error) {
+	serial, err := certSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	dnsNames := opts.DNSNames
+	ipAddresses := opts.IPAddresses
+	if len(dnsNames) == 0 && len(ipAddresses) == 0 {
+		dnsNames = []string{"localhost"}
+		ipAddresses = []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	}
+
+	commonName := opts.CommonName
+	if commonName == "" {
+		if len(opts.DNSNames) != 0 {
+			commonName = opts.DNSNames[0]
+		}else{
+			commonName = "localhost"
+		}
+	}
+
+	validity := opts.Validity
+	if validity <= 0 {
+		validity = 365*24*3*time.Hour
+	}
+
+	notBefore := clockNow()
+	notAfter := notBefore.Add(validity)
+
+	// key encipherment is only used by rsa keys
+	keyUsage := x509.KeyUsageDigitalSignature
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		keyUsage |= x509.KeyUsageKeyAgreement | x509.KeyUsageKeyEncipherment | x509.KeyUsageDataEncipherment
+	}
+
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName: commonName,
+			Organization: opts.Organization,
+			OrganizationalUnit: opts.OrganizationalUnit,
+			Country: opts.Country,
+			Province: opts.Province,
+			Locality: opts.Locality,
+		},
+		DNSNames:              dnsNames,
+		IPAddresses:           ipAddresses,
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		BasicConstraintsValid: true,
+		KeyUsage:              keyUsage,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}, nil
+}
+
+// certSerial returns a random 128 bit serial number
+func certSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// genCertKey generates a new private key of type @keyType
+func genCertKey(keyType CertKeyType) (crypto.Signer, error) {
+	switch keyType {
+	case CertRSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case CertRSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case CertRSA3072:
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case CertECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case CertECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case CertEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+
+	return nil, errors.New("cert: unknown key type")
+}
+
+// marshalKeyPEM pem encodes a private key
+//  - rsa: PKCS#1 (RSA PRIVATE KEY)
+//  - ecdsa: SEC 1 (EC PRIVATE KEY)
+//  - ed25519: PKCS#8 (PRIVATE KEY)
+//
+// if CertKeyPKCS8 is true, every key is encoded as PKCS#8,
+// and if a passphrase is set (see CertKeyPassphraseEnv), the key is encrypted (ENCRYPTED PRIVATE KEY)
+func marshalKeyPEM(key crypto.Signer) ([]byte, error) {
+	pass, err := certKeyPassphrase()
+	if err != nil {
+		return nil, err
+	}
+
+	if pass == nil && !CertKeyPKCS8 {
+		switch k := key.(type) {
+		case *rsa.PrivateKey:
+			return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}), nil
+		case *ecdsa.PrivateKey:
+			keyBytes, err := x509.MarshalECPrivateKey(k)
+			if err != nil {
+				return nil, err
+			}
+			return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}), nil
+		}
+	}
+
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if pass != nil {
+		return encryptKeyPEM(keyBytes, pass)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes}), nil
+}
+
+// parseKeyPEM parses a pem encoded private key
+// (PKCS#1, SEC 1, PKCS#8 or encrypted PKCS#8)
+func parseKeyPEM(buf []byte) (crypto.Signer, error) {
+	buf, err := decryptKeyPEM(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, errors.New("cert: invalid private key")
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("cert: unsupported private key")
+	}
+	return signer, nil
+}
@@ -0,0 +1,300 @@
+package webext
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// LocalCAOpts contains the settings for a local certificate authority
+type LocalCAOpts struct {
+	// Path is the file path to store the certificate authority to
+	// (this will generate a my/path.crt and my/path.key file)
+	//
+	// This is only used by SetLocalCA.
+	//
+	// default: "ca" in the same directory as the certificate
+	Path string
+
+	// CommonName is the subject name of the certificate authority
+	//
+	// default: "WebExt Local CA"
+	CommonName string
+
+	// Organization is an optional subject field of the certificate authority
+	Organization []string
+
+	// Validity is how long the certificate authority is valid for
+	//
+	// default: 10 years
+	Validity time.Duration
+
+	// LeafValidity is how long the certificates issued by the certificate authority are valid for
+	//
+	// default: 398 days
+	LeafValidity time.Duration
+
+	// KeyType is the type of private key to generate for the certificate authority
+	//
+	// default: CertRSA4096
+	KeyType CertKeyType
+}
+
+// LocalCA is a long lived certificate authority, that issues short lived certificates
+//
+// Proxies and internal clients can trust the certificate authority once (see CertPEM and CertDER),
+// and keep trusting the certificates it issues after they are renewed.
+type LocalCA struct {
+	cert *x509.Certificate
+	key crypto.Signer
+	opts LocalCAOpts
+}
+
+var localCAOpts *LocalCAOpts
+var localCAMU sync.Mutex
+
+// SetLocalCA enables issuing the certificates generated by GenRsaKey (and ListenAutoTLS)
+// from a local certificate authority, instead of self signing them.
+// Set it to nil to disable it (default).
+//
+//  webext.SetLocalCA(&webext.LocalCAOpts{})
+//
+//  // export the certificate authority for your proxy
+//  ca, err := webext.LoadLocalCA("db/ssl/ca")
+//  os.WriteFile("ca.pem", ca.CertPEM(), 0644)
+func SetLocalCA(opts *LocalCAOpts) {
+	localCAMU.Lock()
+	defer localCAMU.Unlock()
+
+	if opts != nil {
+		o := *opts
+		opts = &o
+	}
+
+	localCAOpts = opts
+}
+
+// getLocalCA returns the local certificate authority for a certificate at @crtPath,
+// or nil if SetLocalCA is disabled
+func getLocalCA(crtPath string) (*LocalCA, error) {
+	localCAMU.Lock()
+	opts := localCAOpts
+	localCAMU.Unlock()
+
+	if opts == nil {
+		return nil, nil
+	}
+
+	path := opts.Path
+	if path == "" {
+		path = filepath.Join(filepath.Dir(crtPath), "ca")
+	}
+
+	return LoadLocalCA(path, *opts)
+}
+
+// LoadLocalCA loads the local certificate authority stored at @path,
+// or generates a new one if it does not exist
+//
+// @path: file path to store the certificate authority to (this will generate a my/path.crt and my/path.key file)
+//
+// Note: the certificate authority is only regenerated if one of its files is missing, or it has expired.
+// If it cannot be loaded for any other reason (i.e. a wrong passphrase, see CertKeyPassphraseEnv),
+// an error is returned, and the files are left untouched.
+func LoadLocalCA(path string, opts ...LocalCAOpts) (*LocalCA, error) {
+	o := LocalCAOpts{}
+	if len(opts) != 0 {
+		o = opts[0]
+	}
+
+	if o.CommonName == "" {
+		o.CommonName = "WebExt Local CA"
+	}
+	if o.Validity <= 0 {
+		o.Validity = 365*24*10*time.Hour
+	}
+	if o.LeafValidity <= 0 {
+		o.LeafValidity = 398*24*time.Hour
+	}
+
+	// prevent two certificate authorities being generated at the same time
+	// (also by other instances sharing the same files)
+	localCAMU.Lock()
+	defer localCAMU.Unlock()
+
+	unlock, err := lockCertFiles(path+".crt")
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// a key that cannot be decrypted must never be replaced,
+	// or every certificate it issued, and every installed trust anchor, would stop working
+	if err := checkKeyPassphrase(path+".key"); err != nil {
+		return nil, err
+	}
+
+	ca, err := readLocalCA(path+".crt", path+".key")
+	if err == nil && clockNow().Before(ca.cert.NotAfter) {
+		ca.opts = o
+		return ca, nil
+	}else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	PrintMsg(`warn`, "Generating New Certificate Authority...", 50, false)
+
+	ca, err = genLocalCA(path+".crt", path+".key", o)
+	if err != nil {
+		PrintMsg(`error`, "Error: Failed To Generate Certificate Authority!", 50, true)
+		return nil, err
+	}
+
+	PrintMsg(`warn`, "New Certificate Authority Generated!", 50, true)
+
+	return ca, nil
+}
+
+// readLocalCA reads a certificate authority from @crtPath and @keyPath
+func readLocalCA(crtPath string, keyPath string) (*LocalCA, error) {
+	leaf, err := loadCertLeaf(crtPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if !leaf.IsCA {
+		return nil, errors.New("cert: not a certificate authority: "+crtPath)
+	}
+
+	buf, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := parseKeyPEM(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LocalCA{cert: leaf, key: key}, nil
+}
+
+// genLocalCA generates a new certificate authority, and writes it to @crtPath and @keyPath
+func genLocalCA(crtPath string, keyPath string, opts LocalCAOpts) (*LocalCA, error) {
+	key, err := genCertKey(opts.KeyType)
+	if err != nil {
+		return nil, err
+	}
+
+	keyPEM, err := marshalKeyPEM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := certSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	notBefore := clockNow()
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: opts.CommonName, Organization: opts.Organization},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(opts.Validity),
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	os.MkdirAll(filepath.Dir(crtPath), TryPerm(0644, 0755))
+
+	if err := writeCertFiles(crtPath, keyPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes}), keyPEM); err != nil {
+		return nil, err
+	}
+
+	return &LocalCA{cert: cert, key: key, opts: opts}, nil
+}
+
+// Cert returns the certificate of the certificate authority
+func (ca *LocalCA) Cert() *x509.Certificate {
+	return ca.cert
+}
+
+// CertPEM returns the pem encoded certificate of the certificate authority
+func (ca *LocalCA) CertPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+}
+
+// CertDER returns the der encoded certificate of the certificate authority
+func (ca *LocalCA) CertDER() []byte {
+	return ca.cert.Raw
+}
+
+// Issue generates a new certificate and key pair signed by the certificate authority
+//
+// the certificate file also contains the certificate of the certificate authority,
+// so clients receive the full chain.
+//
+// @opts.Validity: default: LocalCAOpts.LeafValidity
+//
+//  ca.Issue(webext.CertOptions{
+//    CrtPath: "db/ssl/internal_api.crt",
+//    KeyPath: "db/ssl/internal_api.key",
+//    DNSNames: []string{"api.internal"},
+//  })
+func (ca *LocalCA) Issue(opts CertOptions) error {
+	return withCertLock(opts.CrtPath, func() error {
+		return ca.issue(opts)
+	})
+}
+
+// issue is the same as Issue, without taking the lock of the certificate
+func (ca *LocalCA) issue(opts CertOptions) error {
+	PrintMsg(`warn`, "Generating New SSL Certificate...", 50, false)
+
+	if opts.Validity <= 0 {
+		opts.Validity = ca.opts.LeafValidity
+	}
+
+	// the certificate should not outlive the certificate authority
+	if notAfter := clockNow().Add(opts.Validity); notAfter.After(ca.cert.NotAfter) {
+		opts.Validity = ca.cert.NotAfter.Sub(clockNow())
+	}
+
+	certPem, keyPEM, err := genCertPEM(opts, ca.cert, ca.key)
+	if err != nil {
+		PrintMsg(`error`, "Error: Failed To Generate SSL Certificate!", 50, true)
+		return err
+	}
+
+	certPem = append(certPem, ca.CertPEM()...)
+
+	if err := writeCertFiles(opts.CrtPath, opts.KeyPath, certPem, keyPEM); err != nil {
+		PrintMsg(`error`, "Error: Failed To Generate SSL Certificate!", 50, true)
+		return err
+	}
+
+	PrintMsg(`warn`, "New SSL Certificate Generated!", 50, true)
+
+	return nil
+}
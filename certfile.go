@@ -0,0 +1,134 @@
+package webext
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// certLockTimeout is how long to wait for another instance to release a lock
+// (issuing an ACME certificate can take a few minutes)
+const certLockTimeout time.Duration = 10 * time.Minute
+
+// lockCertFiles takes an exclusive lock on the certificate at @crtPath,
+// that is shared by every process using the same files (i.e. multiple instances on a shared volume)
+//
+// the lock is an advisory lock on my/path.crt.lock (see lockFile),
+// which is released by the os if the process crashes
+//
+// Note: the lock is not reentrant
+func lockCertFiles(crtPath string) (unlock func(), err error) {
+	unlock, err = lockFile(crtPath+".lock", certLockTimeout)
+	if err != nil {
+		return nil, errors.New("cert: "+err.Error())
+	}
+	return unlock, nil
+}
+
+// withCertLock runs @cb while holding the lock of the certificate at @crtPath (see lockCertFiles)
+func withCertLock(crtPath string, cb func() error) error {
+	unlock, err := lockCertFiles(crtPath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return cb()
+}
+
+// writeTempFile writes @data to a new temp file next to @path, and flushes it to disk
+func writeTempFile(path string, data []byte) (string, error) {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if e := file.Close(); e != nil && err == nil {
+		err = e
+	}
+
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+
+	return file.Name(), nil
+}
+
+// syncDir flushes the entries of a directory to disk (i.e. after a rename)
+//
+// this is not supported on every os, so errors are ignored
+func syncDir(dir string) {
+	if file, err := os.Open(dir); err == nil {
+		file.Sync()
+		file.Close()
+	}
+}
+
+// writeFileAtomic writes @data to @path, so the file is either fully written or unchanged,
+// even if the process crashes
+func writeFileAtomic(path string, data []byte) error {
+	tmpPath, err := writeTempFile(path, data)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+// writeCertFiles writes a certificate and key pair
+//
+// both files are written to temp files and flushed to disk first,
+// so they are only replaced once the new pair is complete.
+//
+// Note: to prevent another instance from writing the same files at the same time,
+// the caller should hold the lock of the certificate (see lockCertFiles)
+//
+// an encrypted key is never replaced by a key that is not encrypted (see CertKeyPassphraseEnv)
+func writeCertFiles(crtPath string, keyPath string, certPem []byte, keyPEM []byte) error {
+	if buf, err := os.ReadFile(keyPath); err == nil && isEncryptedKeyPEM(buf) && !isEncryptedKeyPEM(keyPEM) {
+		return errors.New("cert: refusing to replace an encrypted private key with an unencrypted one: "+keyPath)
+	}
+
+	crtTmp, err := writeTempFile(crtPath, certPem)
+	if err != nil {
+		return err
+	}
+
+	keyTmp, err := writeTempFile(keyPath, keyPEM)
+	if err != nil {
+		os.Remove(crtTmp)
+		return err
+	}
+
+	// a reader may see the new key with the old certificate for a moment,
+	// which fails to load, so readers keep their current pair (see CertReloader)
+	if err := os.Rename(keyTmp, keyPath); err != nil {
+		os.Remove(crtTmp)
+		os.Remove(keyTmp)
+		return err
+	}
+
+	if err := os.Rename(crtTmp, crtPath); err != nil {
+		os.Remove(crtTmp)
+		return err
+	}
+
+	syncDir(filepath.Dir(crtPath))
+	if filepath.Dir(keyPath) != filepath.Dir(crtPath) {
+		syncDir(filepath.Dir(keyPath))
+	}
+
+	return nil
+}
@@ -0,0 +1,244 @@
+package webext
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CertHistoryLimit is the number of previous certificate and key pairs
+// to keep when a certificate is renewed (see ListCertHistory)
+//
+// older pairs are removed by PruneCertHistory
+// (ListenAutoTLS runs it once a day)
+//
+// default: 5
+var CertHistoryLimit int = 5
+
+// certHistoryFormat is the time format of the file names in the history directory
+const certHistoryFormat string = "20060102T150405.000Z"
+
+// CertHistoryEntry is a previous certificate and key pair
+type CertHistoryEntry struct {
+	// Time is when the certificate was replaced
+	Time time.Time
+
+	CrtPath string
+	KeyPath string
+
+	// NotAfter is when the certificate expires
+	// (zero if the certificate cannot be parsed)
+	NotAfter time.Time
+}
+
+// certHistoryDir returns the directory that stores the history of the certificate at @crtPath
+// (i.e. my/path.crt -> my/path.history)
+func certHistoryDir(crtPath string) string {
+	return strings.TrimSuffix(crtPath, filepath.Ext(crtPath))+".history"
+}
+
+// saveCertHistory copies the current certificate and key pair into the history directory
+func saveCertHistory(crtPath string, keyPath string) (CertHistoryEntry, error) {
+	crt, err := os.ReadFile(crtPath)
+	if err != nil {
+		return CertHistoryEntry{}, err
+	}
+
+	key, err := os.ReadFile(keyPath)
+	if err != nil {
+		return CertHistoryEntry{}, err
+	}
+
+	dir := certHistoryDir(crtPath)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return CertHistoryEntry{}, err
+	}
+
+	// an entry is never overwritten, even if two are saved within the same millisecond
+	now := clockNow().UTC()
+	path := filepath.Join(dir, now.Format(certHistoryFormat))
+	for {
+		if _, err := os.Stat(path+".crt"); err != nil {
+			break
+		}
+		now = now.Add(time.Millisecond)
+		path = filepath.Join(dir, now.Format(certHistoryFormat))
+	}
+
+	entry := CertHistoryEntry{
+		Time: now.Truncate(time.Millisecond),
+		CrtPath: path+".crt",
+		KeyPath: path+".key",
+	}
+
+	if err := writeCertFiles(entry.CrtPath, entry.KeyPath, crt, key); err != nil {
+		os.Remove(entry.CrtPath)
+		os.Remove(entry.KeyPath)
+		return CertHistoryEntry{}, err
+	}
+
+	return entry, nil
+}
+
+// keepCertHistory saves the current certificate and key pair to the history before it is replaced,
+// if both files exist
+//
+// Note: the caller should hold the lock of the certificate (see lockCertFiles)
+func keepCertHistory(crtPath string, keyPath string) error {
+	if _, err := os.Stat(crtPath); err != nil {
+		return nil
+	}
+	if _, err := os.Stat(keyPath); err != nil {
+		return nil
+	}
+
+	_, err := saveCertHistory(crtPath, keyPath)
+	return err
+}
+
+// ListCertHistory returns the previous certificate and key pairs of the certificate at @crtPath,
+// sorted from newest to oldest
+//
+// a previous pair is saved every time the certificate is renewed by GenRsaKeyIfNeeded or ListenAutoTLS,
+// and when it is replaced by RollbackCert
+func ListCertHistory(crtPath string) ([]CertHistoryEntry, error) {
+	dir := certHistoryDir(crtPath)
+
+	files, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []CertHistoryEntry{}, nil
+	}else if err != nil {
+		return nil, err
+	}
+
+	entries := []CertHistoryEntry{}
+	for _, file := range files {
+		name, ok := strings.CutSuffix(file.Name(), ".crt")
+		if !ok || file.IsDir() {
+			continue
+		}
+
+		t, err := time.Parse(certHistoryFormat, name)
+		if err != nil {
+			continue
+		}
+
+		entry := CertHistoryEntry{
+			Time: t,
+			CrtPath: filepath.Join(dir, name+".crt"),
+			KeyPath: filepath.Join(dir, name+".key"),
+		}
+
+		if _, err := os.Stat(entry.KeyPath); err != nil {
+			continue
+		}
+
+		if buf, err := os.ReadFile(entry.CrtPath); err == nil {
+			if block, _ := pem.Decode(buf); block != nil {
+				if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+					entry.NotAfter = cert.NotAfter
+				}
+			}
+		}
+
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Time.After(entries[j].Time)
+	})
+
+	return entries, nil
+}
+
+// RollbackCert restores a previous certificate and key pair (see ListCertHistory)
+//
+// @at: the Time of the entry to restore (default: the newest entry)
+//
+// the pair is only restored if the key matches the certificate,
+// and the current pair is saved to the history first, so a rollback can be undone.
+//
+// Note: a certificate that is restored while it is about to expire
+// is renewed again on the next renewal check
+func RollbackCert(crtPath string, keyPath string, at ...time.Time) error {
+	unlock, err := lockCertFiles(crtPath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	entries, err := ListCertHistory(crtPath)
+	if err != nil {
+		return err
+	}
+
+	var entry *CertHistoryEntry
+	for i := range entries {
+		if len(at) == 0 || entries[i].Time.Equal(at[0]) {
+			entry = &entries[i]
+			break
+		}
+	}
+
+	if entry == nil {
+		return errors.New("cert: no history entry to restore: "+crtPath)
+	}
+
+	if _, err := loadKeyPair(entry.CrtPath, entry.KeyPath); err != nil {
+		return err
+	}
+
+	crt, err := os.ReadFile(entry.CrtPath)
+	if err != nil {
+		return err
+	}
+
+	key, err := os.ReadFile(entry.KeyPath)
+	if err != nil {
+		return err
+	}
+
+	if err := keepCertHistory(crtPath, keyPath); err != nil {
+		return err
+	}
+
+	if err := writeCertFiles(crtPath, keyPath, crt, key); err != nil {
+		return err
+	}
+
+	PrintMsg(`warn`, "SSL Certificate Restored From "+entry.Time.Format(time.RFC3339)+"!", 50, true)
+
+	return nil
+}
+
+// PruneCertHistory removes the previous certificate and key pairs of the certificate at @crtPath,
+// except for the newest CertHistoryLimit pairs
+func PruneCertHistory(crtPath string) error {
+	entries, err := ListCertHistory(crtPath)
+	if err != nil {
+		return err
+	}
+
+	limit := CertHistoryLimit
+	if limit < 0 {
+		limit = 0
+	}
+
+	var errs []error
+	for i := limit; i < len(entries); i++ {
+		if err := os.Remove(entries[i].KeyPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+			continue
+		}
+		if err := os.Remove(entries[i].CrtPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
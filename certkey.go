@@ -0,0 +1,274 @@
+package webext
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"os"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// CertKeyPassphraseEnv is the environment variable that contains the passphrase
+// used to encrypt and decrypt private keys at rest.
+//
+// If neither this or CertKeyPassphraseFileEnv are set, private keys are stored unencrypted.
+//
+// default: WEBEXT_KEY_PASSPHRASE
+var CertKeyPassphraseEnv string = "WEBEXT_KEY_PASSPHRASE"
+
+// CertKeyPassphraseFileEnv is the environment variable that contains the path of a file
+// with the passphrase used to encrypt and decrypt private keys at rest.
+//
+// default: WEBEXT_KEY_PASSPHRASE_FILE
+var CertKeyPassphraseFileEnv string = "WEBEXT_KEY_PASSPHRASE_FILE"
+
+// CertKeyPKCS8 writes generated private keys in the PKCS#8 format (PRIVATE KEY),
+// instead of PKCS#1 (RSA PRIVATE KEY) or SEC 1 (EC PRIVATE KEY)
+//
+// Note: encrypted private keys are always written in the PKCS#8 format (ENCRYPTED PRIVATE KEY)
+var CertKeyPKCS8 bool = false
+
+// certKeyIterations is the number of PBKDF2 iterations used to encrypt private keys
+const certKeyIterations int = 600000
+
+// certKeyMaxIterations is the max number of PBKDF2 iterations accepted when decrypting a private key
+const certKeyMaxIterations int = 10 * certKeyIterations
+
+var (
+	oidPBES2 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES256CBC = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+type pkcs8Encrypted struct {
+	Algo pkix.AlgorithmIdentifier
+	Data []byte
+}
+
+type pbes2Params struct {
+	KDF pkix.AlgorithmIdentifier
+	Cipher pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt []byte
+	Iterations int
+	KeyLength int `asn1:"optional"`
+	PRF pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// certKeyPassphrase returns the passphrase for private keys,
+// or nil if private keys should not be encrypted
+func certKeyPassphrase() ([]byte, error) {
+	if pass := os.Getenv(CertKeyPassphraseEnv); pass != "" {
+		return []byte(pass), nil
+	}
+
+	if path := os.Getenv(CertKeyPassphraseFileEnv); path != "" {
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		buf = bytes.TrimRight(buf, "\r\n")
+		if len(buf) == 0 {
+			return nil, errors.New("cert: empty passphrase file: "+path)
+		}
+		return buf, nil
+	}
+
+	return nil, nil
+}
+
+// encryptKeyPEM encrypts a PKCS#8 private key with @pass,
+// and returns it as an ENCRYPTED PRIVATE KEY pem block
+//
+// the key is encrypted with PBES2 (PBKDF2 with HMAC-SHA256, and AES-256-CBC),
+// which can also be read by openssl
+func encryptKeyPEM(pkcs8 []byte, pass []byte) ([]byte, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(pbkdf2.Key(pass, salt, certKeyIterations, 32, sha256.New))
+	if err != nil {
+		return nil, err
+	}
+
+	// PKCS#7 padding
+	padding := aes.BlockSize - len(pkcs8) % aes.BlockSize
+	data := append(append([]byte{}, pkcs8...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+
+	kdfParams, err := asn1.Marshal(pbkdf2Params{
+		Salt: salt,
+		Iterations: certKeyIterations,
+		PRF: pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256, Parameters: asn1.NullRawValue},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ivParams, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+
+	params, err := asn1.Marshal(pbes2Params{
+		KDF: pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdfParams}},
+		Cipher: pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParams}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := asn1.Marshal(pkcs8Encrypted{
+		Algo: pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: params}},
+		Data: data,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: der}), nil
+}
+
+// decryptKeyBlock decrypts an ENCRYPTED PRIVATE KEY pem block with @pass,
+// and returns the PKCS#8 private key
+func decryptKeyBlock(der []byte, pass []byte) ([]byte, error) {
+	var enc pkcs8Encrypted
+	if _, err := asn1.Unmarshal(der, &enc); err != nil {
+		return nil, err
+	}
+	if !enc.Algo.Algorithm.Equal(oidPBES2) {
+		return nil, errors.New("cert: unsupported private key encryption")
+	}
+
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(enc.Algo.Parameters.FullBytes, &params); err != nil {
+		return nil, err
+	}
+	if !params.KDF.Algorithm.Equal(oidPBKDF2) || !params.Cipher.Algorithm.Equal(oidAES256CBC) {
+		return nil, errors.New("cert: unsupported private key encryption")
+	}
+
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KDF.Parameters.FullBytes, &kdf); err != nil {
+		return nil, err
+	}
+	if kdf.PRF.Algorithm != nil && !kdf.PRF.Algorithm.Equal(oidHMACWithSHA256) {
+		return nil, errors.New("cert: unsupported private key encryption")
+	}
+
+	// the iteration count comes from the file, so a corrupted file cannot hang the app
+	if kdf.Iterations <= 0 || kdf.Iterations > certKeyMaxIterations {
+		return nil, errors.New("cert: invalid encrypted private key iterations")
+	}
+
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.Cipher.Parameters.FullBytes, &iv); err != nil {
+		return nil, err
+	}
+
+	if len(iv) != aes.BlockSize || len(enc.Data) == 0 || len(enc.Data) % aes.BlockSize != 0 {
+		return nil, errors.New("cert: invalid encrypted private key")
+	}
+
+	block, err := aes.NewCipher(pbkdf2.Key(pass, kdf.Salt, kdf.Iterations, 32, sha256.New))
+	if err != nil {
+		return nil, err
+	}
+
+	data := append([]byte{}, enc.Data...)
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(data, data)
+
+	// remove PKCS#7 padding
+	padding := int(data[len(data)-1])
+	if padding == 0 || padding > aes.BlockSize || !bytes.Equal(data[len(data)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+		return nil, errors.New("cert: wrong passphrase for private key")
+	}
+
+	return data[:len(data)-padding], nil
+}
+
+// isEncryptedKeyPEM returns true if @keyPEM is an encrypted private key
+func isEncryptedKeyPEM(keyPEM []byte) bool {
+	block, _ := pem.Decode(keyPEM)
+	return block != nil && block.Type == "ENCRYPTED PRIVATE KEY"
+}
+
+// checkKeyPassphrase returns an error if the key at @keyPath is encrypted,
+// and cannot be decrypted with the current passphrase (see CertKeyPassphraseEnv)
+//
+// a key that cannot be decrypted is not a reason to renew a certificate,
+// or it would be replaced by a key that is not encrypted (i.e. if the passphrase is missing)
+func checkKeyPassphrase(keyPath string) error {
+	buf, err := os.ReadFile(keyPath)
+	if err != nil || !isEncryptedKeyPEM(buf) {
+		return nil
+	}
+
+	if _, err := decryptKeyPEM(buf); err != nil {
+		return errors.New(err.Error()+": "+keyPath)
+	}
+	return nil
+}
+
+// decryptKeyPEM decrypts a pem encoded private key in memory, if it is encrypted
+// (see CertKeyPassphraseEnv)
+func decryptKeyPEM(keyPEM []byte) ([]byte, error) {
+	if !isEncryptedKeyPEM(keyPEM) {
+		return keyPEM, nil
+	}
+	block, _ := pem.Decode(keyPEM)
+
+	pass, err := certKeyPassphrase()
+	if err != nil {
+		return nil, err
+	}else if pass == nil {
+		return nil, errors.New("cert: private key is encrypted, but "+CertKeyPassphraseEnv+" is not set")
+	}
+
+	der, err := decryptKeyBlock(block.Bytes, pass)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// loadKeyPair loads a certificate and key pair, and decrypts the key in memory if it is encrypted
+// (same as tls.LoadX509KeyPair)
+func loadKeyPair(crtPath string, keyPath string) (tls.Certificate, error) {
+	certPem, err := os.ReadFile(crtPath)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	keyPEM, err = decryptKeyPEM(keyPEM)
+	if err != nil {
+		return tls.Certificate{}, errors.New(err.Error()+": "+keyPath)
+	}
+
+	return tls.X509KeyPair(certPem, keyPEM)
+}
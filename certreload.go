@@ -0,0 +1,165 @@
+package webext
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CertReloadInterval is how often a CertReloader checks if its files have changed
+//
+// default: 10 seconds
+var CertReloadInterval time.Duration = 10 * time.Second
+
+// CertReloader serves a certificate and key pair from files,
+// and reloads them when they are renewed on disk, without restarting the listener.
+//
+// It can be used as the GetCertificate method of a tls.Config
+//
+//  reloader, err := webext.NewCertReloader("db/ssl/auto_ssl.crt", "db/ssl/auto_ssl.key")
+//  ln, err := tls.Listen("tcp", ":443", &tls.Config{GetCertificate: reloader.GetCertificate})
+type CertReloader struct {
+	crtPath string
+	keyPath string
+
+	cert atomic.Pointer[tls.Certificate]
+
+	// mu prevents multiple reloads at the same time
+	mu sync.Mutex
+
+	// crtStat and keyStat are the stats of the files that are currently loaded
+	crtStat os.FileInfo
+	keyStat os.FileInfo
+
+	// checked is the last time the files were checked for changes (unix milli)
+	checked atomic.Int64
+}
+
+// NewCertReloader loads a certificate and key pair, and returns a CertReloader for them
+func NewCertReloader(crtPath string, keyPath string) (*CertReloader, error) {
+	r := &CertReloader{
+		crtPath: crtPath,
+		keyPath: keyPath,
+	}
+
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Reload loads the certificate and key pair from their files
+//
+// if the files cannot be loaded, or the key does not match the certificate
+// (i.e. while the files are being written), the current certificate is kept
+// and an error is returned.
+func (r *CertReloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.reload()
+}
+
+// Use switches to a different certificate and key pair
+//
+// if the new files cannot be loaded, the current certificate is kept
+// and an error is returned.
+func (r *CertReloader) Use(crtPath string, keyPath string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	oldCrt, oldKey := r.crtPath, r.keyPath
+	r.crtPath, r.keyPath = crtPath, keyPath
+
+	if err := r.reload(); err != nil {
+		r.crtPath, r.keyPath = oldCrt, oldKey
+		return err
+	}
+
+	return nil
+}
+
+// reload loads the certificate and key pair from their files
+//
+// Note: mu must be locked by the caller
+func (r *CertReloader) reload() error {
+	r.checked.Store(clockNow().UnixMilli())
+
+	crtStat, err := os.Stat(r.crtPath)
+	if err != nil {
+		return err
+	}
+	keyStat, err := os.Stat(r.keyPath)
+	if err != nil {
+		return err
+	}
+
+	cert, err := loadKeyPair(r.crtPath, r.keyPath)
+	if err != nil {
+		return err
+	}
+
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+
+	r.cert.Store(&cert)
+	r.crtStat = crtStat
+	r.keyStat = keyStat
+
+	return nil
+}
+
+// Certificate returns the current certificate
+//
+// the parsed certificate is available in its Leaf field
+func (r *CertReloader) Certificate() *tls.Certificate {
+	return r.cert.Load()
+}
+
+// GetCertificate returns the current certificate, and reloads it first
+// if its files have changed (checked at most once every CertReloadInterval)
+func (r *CertReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	now := clockNow().UnixMilli()
+	if now - r.checked.Load() >= CertReloadInterval.Milliseconds() && r.mu.TryLock() {
+		if r.changed() {
+			// on failure, keep serving the current certificate until the next check
+			r.reload()
+		}else{
+			r.checked.Store(now)
+		}
+		r.mu.Unlock()
+	}
+
+	return r.cert.Load(), nil
+}
+
+// changed returns true if the files have been modified since they were loaded
+//
+// Note: mu must be locked by the caller
+func (r *CertReloader) changed() bool {
+	crtStat, err := os.Stat(r.crtPath)
+	if err != nil {
+		return false
+	}
+	keyStat, err := os.Stat(r.keyPath)
+	if err != nil {
+		return false
+	}
+
+	return fileChanged(r.crtStat, crtStat) || fileChanged(r.keyStat, keyStat)
+}
+
+// fileChanged returns true if @stat is not the same file as @old, or it was modified
+//
+// renewed files are written to a temp file and renamed (see writeCertFiles),
+// so a new file is detected even if it has the same modified time
+// (file times can be too coarse to tell two quick writes apart)
+func fileChanged(old os.FileInfo, stat os.FileInfo) bool {
+	return !os.SameFile(old, stat) || !stat.ModTime().Equal(old.ModTime()) || stat.Size() != old.Size()
+}
@@ -0,0 +1,119 @@
+package webext
+
+import (
+	"crypto/x509"
+	"errors"
+	"sync"
+)
+
+// CertFile is a certificate and key pair provided by you (i.e. a Cloudflare Origin CA certificate)
+type CertFile struct {
+	// CrtPath is the file path of the certificate.
+	// The file may also contain the intermediate certificates of the chain.
+	CrtPath string
+
+	// KeyPath is the file path of the private key
+	KeyPath string
+
+	// Roots is an optional pool of root certificates the chain must verify against
+	// (i.e. the Cloudflare Origin CA root).
+	//
+	// If nil, the certificates in the file only need to sign each other.
+	Roots *x509.CertPool
+}
+
+var certFiles []CertFile
+var certFilesMU sync.RWMutex
+
+// SetCertFiles sets certificates provided by you, that ListenAutoTLS serves
+// instead of generating its own, in order of preference.
+//
+// Each certificate is validated when the listener starts, and on every renewal check.
+// Valid certificates are selected by the server name of each connection (see CertStore),
+// and the first valid certificate is also served to any other server name.
+// If none of them are valid, ListenAutoTLS falls back to the certificate it generates.
+//
+// Note: these files are never written to by this module
+//
+//  webext.SetCertFiles(webext.CertFile{
+//    CrtPath: "db/ssl/origin.crt",
+//    KeyPath: "db/ssl/origin.key",
+//  })
+func SetCertFiles(files ...CertFile) {
+	certFilesMU.Lock()
+	defer certFilesMU.Unlock()
+
+	certFiles = append([]CertFile{}, files...)
+}
+
+// userCertFiles returns the valid certificates set by SetCertFiles
+func userCertFiles() []CertFile {
+	certFilesMU.RLock()
+	files := certFiles
+	certFilesMU.RUnlock()
+
+	valid := []CertFile{}
+	for _, file := range files {
+		if err := ValidateCertFile(file); err != nil {
+			PrintMsg(`warn`, "Warning: Invalid SSL Certificate ("+file.CrtPath+"): "+err.Error(), 50, true)
+			continue
+		}
+		valid = append(valid, file)
+	}
+
+	return valid
+}
+
+// ValidateCertFile verifies that a certificate
+//  - matches its private key
+//  - has not expired, and is not used before it is valid
+//  - has a valid chain (against file.Roots, if set)
+func ValidateCertFile(file CertFile) error {
+	pair, err := loadKeyPair(file.CrtPath, file.KeyPath)
+	if err != nil {
+		return err
+	}
+
+	chain := make([]*x509.Certificate, len(pair.Certificate))
+	for i, der := range pair.Certificate {
+		chain[i], err = x509.ParseCertificate(der)
+		if err != nil {
+			return err
+		}
+	}
+
+	now := clockNow()
+	leaf := chain[0]
+
+	if file.Roots != nil {
+		intermediates := x509.NewCertPool()
+		for _, cert := range chain[1:] {
+			intermediates.AddCert(cert)
+		}
+
+		_, err := leaf.Verify(x509.VerifyOptions{
+			Roots: file.Roots,
+			Intermediates: intermediates,
+			CurrentTime: now,
+			KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		})
+		return err
+	}
+
+	for i, cert := range chain {
+		if now.Before(cert.NotBefore) {
+			return errors.New("cert: not valid yet")
+		}
+		if now.After(cert.NotAfter) {
+			return errors.New("cert: expired")
+		}
+
+		if i != 0 {
+			if err := chain[i-1].CheckSignatureFrom(cert); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,307 @@
+package webext
+
+import (
+	"crypto/tls"
+	"errors"
+	"strings"
+	"sync"
+)
+
+// CertStore selects a certificate by the server name of each tls connection (SNI)
+//
+// a certificate is selected by
+//  - an exact match of one of its names (i.e. example.com)
+//  - a wildcard match of one of its names (i.e. *.example.com)
+//  - the default certificate (see SetDefault)
+//
+// Every certificate is served by a CertReloader, so renewed files are picked up automatically.
+//
+// It can be used as the GetCertificate method of a tls.Config
+//
+//  store := webext.NewCertStore()
+//  store.SetDefault("db/ssl/auto_ssl.crt", "db/ssl/auto_ssl.key")
+//  store.Add("db/ssl/customer.crt", "db/ssl/customer.key")
+//  ln, err := tls.Listen("tcp", ":443", &tls.Config{GetCertificate: store.GetCertificate})
+type CertStore struct {
+	// certs contains every certificate in the store (except the default), by crt path
+	certs map[string]*CertReloader
+
+	// order contains the crt paths of certs, in the order they were added
+	order []string
+
+	// names contains the certificate for each server name
+	names map[string]*CertReloader
+
+	def *CertReloader
+
+	mu sync.RWMutex
+}
+
+var certDomains []string
+var certDomainsMU sync.RWMutex
+
+// SetCertDomains sets the domains ListenAutoTLS should generate a separate certificate for
+// (usually the same list of origins you pass to VerifyOrigin)
+//
+// A domain does not get a generated certificate if it is already covered by
+// one of your own certificates (see SetCertFiles), or by the ACME certificate (see SetACME).
+// The generated certificates are stored next to certPath (i.e. my/path.example.com.crt).
+//
+//  webext.SetCertDomains("example.com", "customer.com", "*.customer.com")
+func SetCertDomains(domains ...string) {
+	certDomainsMU.Lock()
+	defer certDomainsMU.Unlock()
+
+	certDomains = append([]string{}, domains...)
+}
+
+// getCertDomains returns the domains set by SetCertDomains
+func getCertDomains() []string {
+	certDomainsMU.RLock()
+	defer certDomainsMU.RUnlock()
+	return certDomains
+}
+
+// NewCertStore returns an empty CertStore
+func NewCertStore() *CertStore {
+	return &CertStore{
+		certs: map[string]*CertReloader{},
+		names: map[string]*CertReloader{},
+	}
+}
+
+// SetDefault sets the certificate that is served when no other certificate matches the server name
+//
+// if the files cannot be loaded, the current default certificate is kept
+// and an error is returned.
+func (s *CertStore) SetDefault(crtPath string, keyPath string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.def != nil {
+		return s.def.Use(crtPath, keyPath)
+	}
+
+	r, err := NewCertReloader(crtPath, keyPath)
+	if err != nil {
+		return err
+	}
+
+	s.def = r
+	return nil
+}
+
+// Add adds a certificate and key pair to the store, for every name the certificate is valid for
+//
+// if the certificate was already added, it is reloaded.
+// If multiple certificates are valid for the same name, the first one added is used.
+func (s *CertStore) Add(crtPath string, keyPath string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r, ok := s.certs[crtPath]; ok {
+		if err := r.Use(crtPath, keyPath); err != nil {
+			return err
+		}
+	}else{
+		r, err := NewCertReloader(crtPath, keyPath)
+		if err != nil {
+			return err
+		}
+
+		s.certs[crtPath] = r
+		s.order = append(s.order, crtPath)
+	}
+
+	s.index()
+	return nil
+}
+
+// Remove removes a certificate from the store
+func (s *CertStore) Remove(crtPath string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.certs[crtPath]; !ok {
+		return
+	}
+
+	delete(s.certs, crtPath)
+	for i, path := range s.order {
+		if path == crtPath {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+
+	s.index()
+}
+
+// index rebuilds the names of every certificate
+//
+// Note: mu must be locked by the caller
+func (s *CertStore) index() {
+	names := map[string]*CertReloader{}
+
+	for _, path := range s.order {
+		r := s.certs[path]
+
+		leaf := r.Certificate().Leaf
+		certNames := leaf.DNSNames
+		if len(certNames) == 0 && leaf.Subject.CommonName != "" {
+			certNames = []string{leaf.Subject.CommonName}
+		}
+
+		for _, name := range certNames {
+			name = strings.ToLower(name)
+			if _, ok := names[name]; !ok {
+				names[name] = r
+			}
+		}
+	}
+
+	s.names = names
+}
+
+// lookup returns the certificate for a server name, without the default certificate
+func (s *CertStore) lookup(name string) (*CertReloader, bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if r, ok := s.names[name]; ok {
+		return r, true
+	}
+
+	if i := strings.IndexByte(name, '.'); i != -1 {
+		if r, ok := s.names["*"+name[i:]]; ok {
+			return r, true
+		}
+	}
+
+	return nil, false
+}
+
+// GetCertificate returns the certificate for the server name of a tls connection
+func (s *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if r, ok := s.lookup(hello.ServerName); ok {
+		return r.GetCertificate(hello)
+	}
+
+	s.mu.RLock()
+	def := s.def
+	s.mu.RUnlock()
+
+	if def == nil {
+		return nil, errors.New("cert: no certificate for "+hello.ServerName)
+	}
+	return def.GetCertificate(hello)
+}
+
+// refreshAutoTLS updates the certificates of a CertStore used by ListenAutoTLS
+//  - adds your own valid certificates (see SetCertFiles), and removes invalid ones
+//  - generates or renews a certificate for each domain set by SetCertDomains,
+//    that is not covered by your own certificates or the ACME certificate
+//
+// @files: your own valid certificates
+func refreshAutoTLS(store *CertStore, certPath string, files []CertFile, acmeOpts *ACMEOpts) error {
+	keep := map[string]bool{}
+
+	var errs []error
+	for _, file := range files {
+		if err := store.Add(file.CrtPath, file.KeyPath); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		keep[file.CrtPath] = true
+	}
+
+	for _, domain := range getCertDomains() {
+		if store.covers(files, domain) {
+			continue
+		}
+
+		if acmeOpts != nil && certHasName(acmeOpts.Domains, domain) {
+			continue
+		}
+
+		path := autoTLSDomainPath(certPath, domain)
+		opts := CertOptions{
+			CrtPath: path+".crt",
+			KeyPath: path+".key",
+			DNSNames: []string{domain},
+		}
+
+		if err := genCertIfNeeded(opts); err != nil {
+			errs = append(errs, err)
+		}
+
+		if err := store.Add(opts.CrtPath, opts.KeyPath); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		keep[opts.CrtPath] = true
+	}
+
+	// remove certificates that are no longer valid, or no longer needed
+	store.mu.RLock()
+	remove := []string{}
+	for path := range store.certs {
+		if !keep[path] {
+			remove = append(remove, path)
+		}
+	}
+	store.mu.RUnlock()
+
+	for _, path := range remove {
+		store.Remove(path)
+	}
+
+	return errors.Join(errs...)
+}
+
+// autoTLSDomainPath returns the path of the generated certificate for @domain
+// (without the .crt or .key extension)
+func autoTLSDomainPath(certPath string, domain string) string {
+	return certPath+"."+strings.ReplaceAll(domain, "*", "_")
+}
+
+// autoTLSCertPaths returns the crt paths of every certificate ListenAutoTLS may generate
+func autoTLSCertPaths(certPath string) []string {
+	paths := []string{certPath+".crt"}
+	for _, domain := range getCertDomains() {
+		paths = append(paths, autoTLSDomainPath(certPath, domain)+".crt")
+	}
+	return paths
+}
+
+// covers returns true if one of @files in the store is valid for @name
+func (s *CertStore) covers(files []CertFile, name string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, file := range files {
+		r, ok := s.certs[file.CrtPath]
+		if !ok {
+			continue
+		}
+
+		leaf := r.Certificate().Leaf
+		if certHasName(leaf.DNSNames, name) || leaf.VerifyHostname(name) == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// certHasName returns true if @name is in @names (case insensitive)
+func certHasName(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
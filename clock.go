@@ -0,0 +1,191 @@
+package webext
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the source of time used by cron jobs, certificate renewal and login form sessions.
+//
+// By default, the system clock is used. You can replace it with SetClock,
+// which is mostly useful for tests (see NewFakeClock).
+type Clock interface {
+	// Now returns the current time
+	Now() time.Time
+
+	// NewTimer returns a timer that sends the current time on its channel after @d
+	NewTimer(d time.Duration) ClockTimer
+}
+
+// ClockTimer is a timer created by a Clock
+type ClockTimer interface {
+	// C returns the channel the time is sent on when the timer fires
+	C() <-chan time.Time
+
+	// Stop prevents the timer from firing.
+	// It returns false if the timer already fired or was stopped.
+	Stop() bool
+}
+
+var clock Clock = realClock{}
+var clockMU sync.RWMutex
+
+// SetClock replaces the clock used by this module
+//
+// set it to nil to go back to the system clock
+func SetClock(c Clock) {
+	if c == nil {
+		c = realClock{}
+	}
+
+	clockMU.Lock()
+	clock = c
+	clockMU.Unlock()
+
+	// wake the cron scheduler, so it sets its timer on the new clock
+	select {
+	case cronWake <- struct{}{}:
+	default:
+	}
+}
+
+// getClock returns the current clock
+func getClock() Clock {
+	clockMU.RLock()
+	defer clockMU.RUnlock()
+	return clock
+}
+
+// clockNow returns the current time of the current clock
+func clockNow() time.Time {
+	return getClock().Now()
+}
+
+type realClock struct {}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) ClockTimer {
+	return realTimer{time.NewTimer(d)}
+}
+
+type realTimer struct {
+	t *time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.t.C
+}
+
+func (t realTimer) Stop() bool {
+	return t.t.Stop()
+}
+
+// FakeClock is a Clock that only moves when you tell it to
+//
+//  clock := webext.NewFakeClock(time.Now())
+//  webext.SetClock(clock)
+//  defer webext.SetClock(nil)
+//
+//  clock.Advance(24 * time.Hour) // runs any cron job that was due within the next day
+type FakeClock struct {
+	now time.Time
+	timers []*fakeTimer
+	mu sync.Mutex
+}
+
+type fakeTimer struct {
+	clock *FakeClock
+	at time.Time
+	c chan time.Time
+}
+
+// NewFakeClock returns a FakeClock starting at @now
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now returns the current time of the fake clock
+func (clock *FakeClock) Now() time.Time {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	return clock.now
+}
+
+// NewTimer returns a timer that fires when the fake clock is moved forward by @d
+func (clock *FakeClock) NewTimer(d time.Duration) ClockTimer {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+
+	t := &fakeTimer{
+		clock: clock,
+		at: clock.now.Add(d),
+		c: make(chan time.Time, 1),
+	}
+
+	if d <= 0 {
+		t.c <- clock.now
+		return t
+	}
+
+	clock.timers = append(clock.timers, t)
+	return t
+}
+
+// Advance moves the fake clock forward by @d, and fires any timers that are due
+func (clock *FakeClock) Advance(d time.Duration) {
+	clock.mu.Lock()
+	clock.set(clock.now.Add(d))
+	clock.mu.Unlock()
+}
+
+// Set moves the fake clock to @t, and fires any timers that are due
+func (clock *FakeClock) Set(t time.Time) {
+	clock.mu.Lock()
+	clock.set(t)
+	clock.mu.Unlock()
+}
+
+// set changes the time and fires timers
+//
+// Note: mu must be locked by the caller
+func (clock *FakeClock) set(t time.Time) {
+	clock.now = t
+
+	timers := clock.timers[:0]
+	for _, timer := range clock.timers {
+		if timer.at.After(t) {
+			timers = append(timers, timer)
+			continue
+		}
+
+		select {
+		case timer.c <- t:
+		default:
+		}
+	}
+
+	for i := len(timers); i < len(clock.timers); i++ {
+		clock.timers[i] = nil
+	}
+	clock.timers = timers
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	for i, timer := range t.clock.timers {
+		if timer == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -1,105 +1,1145 @@
 package webext
 
 import (
-	"io"
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	mathrand "math/rand"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
+)
+
+// CronMinInterval is the shortest interval a cron job is allowed to run at.
+// Any job with a shorter interval will be raised to this value.
+//
+// default: 1 minute
+//
+// You can lower this value (before adding your jobs) to opt-in to sub-minute intervals.
+//  webext.CronMinInterval = 10 * time.Second
+//
+// Note: this value cannot go below 1 second
+var CronMinInterval time.Duration = 1 * time.Minute
+
+// CronWorkers is the number of goroutines that run cron callbacks.
+// A job that is due while all workers are busy will wait for the next free worker.
+//
+// default: 4
+//
+// Note: this value is read when the scheduler starts, so it should be set before adding your jobs
+var CronWorkers int = 4
 
-	"github.com/AspieSoft/goutil/crypt"
+// ErrStopCron can be returned by a context cron job to end the job
+var ErrStopCron error = errors.New("cron: stop job")
+
+// ErrCronNotFound is returned when a named cron job does not exist
+var ErrCronNotFound error = errors.New("cron: job not found")
+
+// CronOverlap decides what happens when a cron job is due
+// while its previous run is still executing
+type CronOverlap uint8
+
+const (
+	// CronSkip skips the new run (default)
+	CronSkip CronOverlap = iota
+
+	// CronQueue runs the job again as soon as the previous run finishes
+	//
+	// Note: at most one run is queued at a time, so multiple missed runs are merged into one
+	CronQueue
+
+	// CronConcurrent allows multiple runs of the same job to execute at the same time
+	CronConcurrent
 )
 
+// CronOpts contains optional settings for a cron job
+type CronOpts struct {
+	// Overlap decides what happens when the job is due while its previous run is still executing
+	//
+	// default: CronSkip
+	Overlap CronOverlap
+
+	// Timeout cancels the context passed to the job after this duration
+	//
+	// default: 0 (no timeout)
+	Timeout time.Duration
+
+	// CatchUp runs a named job as soon as it is added, if it was due while the process was down
+	//
+	// Note: this requires a CronStore (see SetCronStore)
+	CatchUp bool
+
+	// Retries is the number of times a failed run will be retried before
+	// waiting for the next scheduled run
+	//
+	// a run fails if it returns an error (other than ErrStopCron) or panics
+	//
+	// default: 0 (no retries)
+	Retries int
+
+	// RetryDelay is the time to wait before the first retry.
+	// The delay is doubled after each failed retry.
+	//
+	// default: 10 seconds
+	RetryDelay time.Duration
+
+	// RetryMaxDelay is the longest delay between retries
+	//
+	// default: 1 hour
+	RetryMaxDelay time.Duration
+
+	// LockTTL is how long the lease of a run is valid for, if a CronLocker is set (see SetCronLocker).
+	// The lease is renewed while the job is running, so this is how long it takes
+	// for another instance to take over if this instance dies mid-job.
+	//
+	// default: 1 minute
+	LockTTL time.Duration
+
+	// Jitter adds a random delay between 0 and Jitter to each scheduled run,
+	// so many instances with the same job do not all run at the exact same time
+	//
+	// default: 0 (no jitter)
+	Jitter time.Duration
+
+	// Location is the time zone cron expressions are evaluated in
+	// (see SetCronSpec)
+	//
+	// default: time.Local
+	Location *time.Location
+}
+
 type cronJob struct {
+	name string
 	interval int64
-	last *int64
-	cb func() bool
+	spec *cronSpec
+
+	// once is true for jobs added by RunAt and RunAfter
+	once bool
+
+	last int64
+	next int64
+	opts CronOpts
+
+	// index is the position of the job in the cronQueue heap
+	index int
+
+	// running is the number of runs currently executing
+	running int
+
+	// queued is true if a run is waiting for the previous run to finish
+	queued bool
+
+	// retry is the time of the next retry after a failed run (0 if none)
+	retry int64
+
+	// attempt is the number of retries since the last scheduled run
+	attempt int
+
+	// paused is true if scheduled runs should be skipped
+	paused bool
+
+	// trigger is true if RunCronNow or CronJob.RunNow was called, and the job should run as soon as possible
+	trigger bool
+
+	// slot is the time the current run was scheduled for (used by the CronLocker)
+	slot int64
+
+	// delay is the random jitter added to the next run
+	delay int64
+
+	runs int
+	lastDuration time.Duration
+	lastErr error
+
+	cb func(ctx context.Context) error
 }
 
-var cron map[string]cronJob = map[string]cronJob{}
+var cron map[string]*cronJob = map[string]*cronJob{}
 var cronMU sync.Mutex
 
+// cronQueue is a min-heap of jobs, sorted by their next run time
+var cronQueue cronHeap = cronHeap{}
+
+// cronWake is used to wake up the scheduler when the queue changes
+var cronWake chan struct{} = make(chan struct{}, 1)
+
+// cronRun is the currently running scheduler (nil if stopped)
+var cronRun *cronRunner
+
+// cronID is used to generate the names of unnamed jobs
+var cronID uint64
+
+// cronNever is used as the next run time of a one time job that already started
+const cronNever int64 = math.MaxInt64
+
+type cronHeap []*cronJob
+
 func init(){
-	go func() {
+	if Hooks.OnCronError == nil {
+		Hooks.OnCronError = func(name string, err error) {
+			if name == "" {
+				PrintMsg(`error`, "Cron Error: "+err.Error(), 50, true)
+				return
+			}
+			PrintMsg(`error`, "Cron Error ("+name+"): "+err.Error(), 50, true)
+		}
+	}
+}
+
+func (h cronHeap) Len() int { return len(h) }
+func (h cronHeap) Less(i, j int) bool { return h[i].due() < h[j].due() }
+
+func (h cronHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *cronHeap) Push(x any) {
+	c := x.(*cronJob)
+	c.index = len(*h)
+	*h = append(*h, c)
+}
+
+func (h *cronHeap) Pop() any {
+	old := *h
+	n := len(old)
+	c := old[n-1]
+	old[n-1] = nil
+	c.index = -1
+	*h = old[:n-1]
+	return c
+}
+
+// due returns the next time the job should run, including retries
+func (c *cronJob) due() int64 {
+	if c.trigger {
+		return 0
+	}
+
+	next := c.scheduled()
+	if c.retry != 0 && c.retry < next {
+		return c.retry
+	}
+	return next
+}
+
+// scheduled returns the next scheduled run, including its jitter
+func (c *cronJob) scheduled() int64 {
+	if c.next == cronNever {
+		return cronNever
+	}
+	return c.next + c.delay
+}
+
+// setNext sets the next scheduled run, and picks a new jitter for it
+func (c *cronJob) setNext(next int64) {
+	c.next = next
+	c.delay = 0
+
+	if jitter := c.opts.Jitter.Milliseconds(); jitter > 0 && next != cronNever {
+		c.delay = mathrand.Int63n(jitter)
+	}
+}
+
+// location returns the time zone cron expressions are evaluated in
+func (opts CronOpts) location() *time.Location {
+	if opts.Location != nil {
+		return opts.Location
+	}
+	return time.Local
+}
+
+// cronRunner owns the scheduler goroutine and its worker pool
+type cronRunner struct {
+	// ctx is the parent context of every job, and is canceled
+	// if StopCron gives up on waiting for the running jobs
+	ctx context.Context
+	cancel context.CancelFunc
+
+	// quit is closed to stop the scheduler
+	quit chan struct{}
+
+	// tasks sends due jobs from the scheduler to the worker pool
+	tasks chan *cronJob
+
+	// wg waits for the scheduler and the workers to exit
+	wg sync.WaitGroup
+}
+
+// cronStart starts the scheduler if it is not already running
+//
+// Note: cronMU must be locked by the caller
+func cronStart() {
+	if cronRun != nil {
+		return
+	}
+
+	r := &cronRunner{
+		quit: make(chan struct{}),
+		tasks: make(chan *cronJob),
+	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+
+	n := CronWorkers
+	if n < 1 {
+		n = 1
+	}
+
+	r.wg.Add(n + 1)
+	go r.schedule()
+	for i := 0; i < n; i++ {
+		go r.worker()
+	}
+
+	cronRun = r
+}
+
+// schedule sleeps until the next job is due, and sends it to the worker pool
+func (r *cronRunner) schedule() {
+	defer r.wg.Done()
+	defer close(r.tasks)
+
+	for {
+		cronMU.Lock()
+
+		now := clockNow().UnixMilli()
+
+		due := []*cronJob{}
+		for len(cronQueue) != 0 && cronQueue[0].due() <= now {
+			c := cronQueue[0]
+			manual := c.trigger
+
+			if c.trigger {
+				// run now, without changing the schedule
+				c.trigger = false
+				c.slot = now
+				heap.Fix(&cronQueue, c.index)
+			}else if c.retry != 0 && c.retry < c.scheduled() {
+				// retry a failed run, without changing the schedule
+				c.retry = 0
+				heap.Fix(&cronQueue, c.index)
+			}else if c.once {
+				// keep the job in the queue until it finishes, so it can be retried
+				c.retry = 0
+				c.attempt = 0
+				c.slot = c.next
+
+				c.setNext(cronNever)
+				heap.Fix(&cronQueue, c.index)
+			}else if c.spec != nil {
+				c.retry = 0
+				c.attempt = 0
+				c.slot = c.next
+
+				// search from the scheduled time (without jitter), so runs are not skipped
+				next := c.spec.next(time.UnixMilli(now - c.delay).In(c.opts.location()))
+				if next.IsZero() {
+					cronRemove(c)
+				}else{
+					c.setNext(next.UnixMilli())
+					heap.Fix(&cronQueue, c.index)
+				}
+			}else{
+				c.retry = 0
+				c.attempt = 0
+				c.slot = c.next
+
+				c.setNext(cronNextInterval(c, now))
+				heap.Fix(&cronQueue, c.index)
+			}
+
+			if c.paused && !manual {
+				continue
+			}
+
+			if c.running == 0 || c.opts.Overlap == CronConcurrent {
+				c.last = now
+				c.running++
+				due = append(due, c)
+			}else if c.opts.Overlap == CronQueue {
+				c.queued = true
+			}
+		}
+
+		wait := time.Duration(-1)
+		var at int64
+		if len(cronQueue) != 0 && cronQueue[0].due() != cronNever {
+			at = cronQueue[0].due()
+			wait = time.Duration(at - now) * time.Millisecond
+			if wait < 0 {
+				wait = 0
+			}
+		}
+
+		cronMU.Unlock()
+
+		// callbacks run on the worker pool, so the lock is not held while they run
+		for i, c := range due {
+			select {
+			case r.tasks <- c:
+			case <-r.quit:
+				cronMU.Lock()
+				for _, c := range due[i:] {
+					c.running--
+				}
+				cronMU.Unlock()
+				return
+			}
+		}
+
+		// sleep until the next job is due, or until the queue changes
+		var timer ClockTimer
+		var timerC <-chan time.Time
+		if wait >= 0 {
+			clock := getClock()
+			timer = clock.NewTimer(wait)
+			timerC = timer.C()
+
+			// the clock may have moved while the timer was being created
+			// (this can happen with a FakeClock)
+			if clock.Now().UnixMilli() >= at {
+				timer.Stop()
+				continue
+			}
+		}
+
+		select {
+		case <-timerC:
+		case <-cronWake:
+		case <-r.quit:
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+
+		if r.stopped() {
+			return
+		}
+	}
+}
+
+// worker runs jobs sent by the scheduler
+func (r *cronRunner) worker() {
+	defer r.wg.Done()
+
+	for c := range r.tasks {
 		for {
-			time.Sleep(1 * time.Second)
+			lease, ok := r.lock(c)
+			if !ok {
+				cronMU.Lock()
+				c.running--
+				cronMU.Unlock()
+				break
+			}
 
-			now := time.Now().UnixMilli()
+			// one time jobs are only saved after they finish
+			if !c.once {
+				cronSave(c)
+			}
+
+			start := clockNow()
+			err := r.exec(c, lease)
 
 			cronMU.Lock()
 
-			for key, c := range cron {
-				if now > *c.last + c.interval {
-					*cron[key].last = now
-					if !c.cb() {
-						delete(cron, key)
-					}
+			c.running--
+			c.runs++
+			c.lastDuration = clockNow().Sub(start)
+			c.lastErr = err
+			if errors.Is(err, ErrStopCron) {
+				c.lastErr = nil
+			}
+
+			if errors.Is(err, ErrStopCron) {
+				c.queued = false
+				replaced := cron[c.name] != c
+				cronRemove(c)
+				cronMU.Unlock()
+
+				// do not forget the state of a new job with the same name
+				if !replaced {
+					cronForget(c.name)
+				}
+				break
+			}
+
+			if err != nil && c.index != -1 && c.attempt < c.opts.Retries {
+				c.retry = clockNow().Add(cronRetryDelay(c.opts, c.attempt)).UnixMilli()
+				c.attempt++
+
+				// the lease of the failed run was released, so the retry takes a new one (see CronLocker)
+				c.slot = c.retry
+				heap.Fix(&cronQueue, c.index)
+
+				select {
+				case cronWake <- struct{}{}:
+				default:
 				}
 			}
 
+			// a one time job is done once it succeeds or runs out of retries
+			if c.once && c.index != -1 && c.retry == 0 {
+				replaced := cron[c.name] != c
+				cronRemove(c)
+				cronMU.Unlock()
+
+				if !replaced {
+					cronSaveDone(c)
+				}
+
+				if err != nil {
+					cronError(c.name, err)
+				}
+				break
+			}
+
+			// run again if a run was queued while this one was executing
+			if c.queued && c.index != -1 && !r.stopped() {
+				// the slot was set by the scheduler when the run was queued,
+				// so every instance takes the lease for the same run (see CronLocker)
+				c.queued = false
+				c.last = clockNow().UnixMilli()
+				c.running++
+				cronMU.Unlock()
+
+				if err != nil {
+					cronError(c.name, err)
+				}
+				continue
+			}
+
 			cronMU.Unlock()
+
+			if err != nil {
+				cronError(c.name, err)
+			}
+			break
+		}
+	}
+}
+
+// lock takes the lease of a named job if a CronLocker is set
+//
+// it returns false if the run should be skipped, because another instance
+// is running it, or already ran it
+func (r *cronRunner) lock(c *cronJob) (CronLease, bool) {
+	cronMU.Lock()
+	locker := cronLocker
+	owner := cronOwner
+	slot := c.slot
+	cronMU.Unlock()
+
+	key, named := cronStoreName(c.name)
+	if locker == nil || !named {
+		return nil, true
+	}
+
+	lease, retry, err := locker.Acquire(key, owner, time.UnixMilli(slot), c.opts.lockTTL())
+	if err != nil {
+		cronError(c.name, err)
+		return nil, false
+	}
+
+	if lease != nil {
+		return lease, true
+	}
+
+	cronMU.Lock()
+	defer cronMU.Unlock()
+
+	if c.index == -1 {
+		return nil, false
+	}
+
+	if !retry.IsZero() {
+		// try to take over the run if the other instance stops renewing its lease
+		c.retry = retry.UnixMilli()
+		heap.Fix(&cronQueue, c.index)
+
+		select {
+		case cronWake <- struct{}{}:
+		default:
+		}
+	}else if c.once && c.retry == 0 {
+		// the job already ran on another instance
+		cronRemove(c)
+	}
+
+	return nil, false
+}
+
+// exec runs a single job with its timeout, and recovers from a panic
+//
+// if @lease is not nil, it is renewed while the job is running, and released after.
+// If the lease is lost, the context passed to the job is canceled.
+func (r *cronRunner) exec(c *cronJob, lease CronLease) (err error) {
+	ctx := r.ctx
+	if c.opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.opts.Timeout)
+		defer cancel()
+	}
+
+	if lease != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+
+		done := make(chan struct{})
+		renewed := make(chan struct{})
+		go func(){
+			defer close(renewed)
+
+			ttl := c.opts.lockTTL()
+			for {
+				timer := getClock().NewTimer(ttl / 3)
+				select {
+				case <-done:
+					timer.Stop()
+					return
+				case <-timer.C():
+				}
+
+				if err := lease.Renew(ttl); err != nil {
+					cronError(c.name, err)
+					if errors.Is(err, ErrCronLeaseLost) {
+						cancel()
+						return
+					}
+				}
+			}
+		}()
+
+		defer func(){
+			close(done)
+			<-renewed
+			cancel()
+
+			if err := lease.Release(); err != nil {
+				cronError(c.name, err)
+			}
+		}()
+	}
+
+	defer func(){
+		if e := recover(); e != nil {
+			err = fmt.Errorf("cron: job panicked: %v", e)
 		}
 	}()
+
+	return c.cb(ctx)
 }
 
-// NewCron adds a new, unnamed cron job to the queue
+// cronNextInterval returns the next run time of an interval job
 //
-// minimum interval: 1 minute
+// if a CronLocker is set, named jobs are aligned to multiples of their interval,
+// so every instance schedules the same runs
 //
-// in the callback, return true to keep the job running,
-// and return false to end the job
-func NewCron(interval time.Duration, cb func() bool) error {
-	intrv := interval.Milliseconds()
-	if intrv < 60000 {
-		intrv = 60000
+// Note: cronMU must be locked by the caller
+func cronNextInterval(c *cronJob, now int64) int64 {
+	if _, named := cronStoreName(c.name); cronLocker != nil && named {
+		return (now / c.interval + 1) * c.interval
 	}
 
-	now := time.Now().UnixMilli()
+	// keep the jitter from adding up over time
+	if c.opts.Jitter > 0 && c.slot != 0 && c.slot + c.interval > now {
+		return c.slot + c.interval
+	}
+
+	return now + c.interval
+}
+
+// cronRetryDelay returns the backoff delay before a retry
+func cronRetryDelay(opts CronOpts, attempt int) time.Duration {
+	delay := opts.RetryDelay
+	if delay <= 0 {
+		delay = 10 * time.Second
+	}
+
+	max := opts.RetryMaxDelay
+	if max <= 0 {
+		max = 1 * time.Hour
+	}
+
+	for i := 0; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// cronError sends an error to the OnCronError hook
+func cronError(name string, err error) {
+	name, _ = cronStoreName(name)
+
+	if Hooks.OnCronError != nil {
+		Hooks.OnCronError(name, err)
+	}
+}
+
+// stopped returns true if StopCron was called on this scheduler
+func (r *cronRunner) stopped() bool {
+	select {
+	case <-r.quit:
+		return true
+	default:
+		return false
+	}
+}
 
+// StopCron stops the cron scheduler and waits for any running jobs to finish.
+//
+// If @ctx is done before the running jobs finish, the context passed to those jobs
+// is canceled, and the error from @ctx is returned.
+//
+// Registered jobs are kept, and the scheduler will start again
+// the next time a cron job is added.
+func StopCron(ctx context.Context) error {
 	cronMU.Lock()
-	defer cronMU.Unlock()
+	r := cronRun
+	cronRun = nil
+	if r != nil {
+		close(r.quit)
+	}
+	cronMU.Unlock()
 
-	name := "+job:"+string(crypt.RandBytes(16))
+	if r == nil {
+		return nil
+	}
 
-	loops := 1000
-	for loops > 0 {
-		if _, ok := cron[name]; !ok {
-			break
+	done := make(chan struct{})
+	go func(){
+		r.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		r.cancel()
+		return nil
+	case <-ctx.Done():
+		r.cancel()
+		return ctx.Err()
+	}
+}
+
+// cronAdd adds a job to the queue, and replaces any job with the same name
+//
+// Note: cronMU must be locked by the caller
+func cronAdd(c *cronJob) {
+	if old, ok := cron[c.name]; ok {
+		cronRemove(old)
+	}
+
+	c.setNext(c.next)
+
+	cron[c.name] = c
+	heap.Push(&cronQueue, c)
+
+	cronStart()
+
+	select {
+	case cronWake <- struct{}{}:
+	default:
+	}
+}
+
+// cronRemove removes a job from the queue
+//
+// Note: cronMU must be locked by the caller
+func cronRemove(c *cronJob) {
+	if c.index != -1 {
+		heap.Remove(&cronQueue, c.index)
+	}
+
+	if cron[c.name] == c {
+		delete(cron, c.name)
+	}
+}
+
+// cronInterval converts an interval to milliseconds,
+// and enforces the CronMinInterval
+func cronInterval(interval time.Duration) int64 {
+	min := CronMinInterval
+	if min < time.Second {
+		min = time.Second
+	}
+
+	if interval < min {
+		interval = min
+	}
+
+	return interval.Milliseconds()
+}
+
+// cronTime converts a unix millisecond time into a time.Time,
+// and returns a zero time for 0
+func cronTime(ms int64) time.Time {
+	if ms == 0 || ms == cronNever {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms)
+}
+
+// cronOpts returns the first CronOpts, or the defaults if none were passed
+func cronOpts(opts []CronOpts) CronOpts {
+	if len(opts) != 0 {
+		return opts[0]
+	}
+	return CronOpts{}
+}
+
+// cronBool converts a `func() bool` callback into a context job
+func cronBool(cb func() bool) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		if !cb() {
+			return ErrStopCron
 		}
-		loops--
-		name += string(crypt.RandBytes(16))
+		return nil
 	}
+}
 
-	if _, ok := cron[name]; ok {
-		return io.EOF
+// newCron adds an unnamed interval job
+func newCron(interval time.Duration, cb func(ctx context.Context) error, opts []CronOpts) *CronJob {
+	intrv := cronInterval(interval)
+
+	now := clockNow().UnixMilli()
+
+	cronMU.Lock()
+	defer cronMU.Unlock()
+
+	// unnamed jobs use a "+job:" prefix, so they can never collide with named "#job:" jobs
+	cronID++
+	c := &cronJob{
+		name: "+job:"+strconv.FormatUint(cronID, 10),
+		interval: intrv,
+		next: now + intrv,
+		opts: cronOpts(opts),
+		cb: cb,
 	}
 
-	cron[name] = cronJob{
+	cronAdd(c)
+
+	return &CronJob{job: c}
+}
+
+// setCron adds or overwrites a named interval job
+func setCron(name string, interval time.Duration, cb func(ctx context.Context) error, opts []CronOpts) {
+	name = "#job:" + name
+
+	intrv := cronInterval(interval)
+
+	state, hasState := cronLoad(name)
+
+	now := clockNow().UnixMilli()
+
+	c := &cronJob{
+		name: name,
 		interval: intrv,
-		last: &now,
+		next: now + intrv,
+		opts: cronOpts(opts),
 		cb: cb,
 	}
 
+	cronMU.Lock()
+	c.next = cronNextInterval(c, now)
+	if hasState {
+		c.restore(state, now)
+	}
+	cronAdd(c)
+	cronMU.Unlock()
+
+	cronSave(c)
+}
+
+// setCronSpec adds or overwrites a named cron expression job
+func setCronSpec(name string, spec string, cb func(ctx context.Context) error, opts []CronOpts) error {
+	name = "#job:" + name
+
+	s, err := parseCronSpec(spec)
+	if err != nil {
+		return err
+	}
+
+	state, hasState := cronLoad(name)
+
+	now := clockNow()
+	next := s.next(now.In(cronOpts(opts).location()))
+	if next.IsZero() {
+		return errors.New("cron: expression never matches: "+spec)
+	}
+
+	c := &cronJob{
+		name: name,
+		spec: s,
+		next: next.UnixMilli(),
+		opts: cronOpts(opts),
+		cb: cb,
+	}
+
+	if hasState {
+		c.restore(state, now.UnixMilli())
+	}
+
+	cronMU.Lock()
+	cronAdd(c)
+	cronMU.Unlock()
+
+	cronSave(c)
+
 	return nil
 }
 
-// SetCron adds or overwrites a named cron job
-func SetCron(name string, interval time.Duration, cb func() bool){
+// runOnce adds or overwrites a named one time job
+//
+// @pending: if true, and the job was already added before a restart,
+// the saved run time is used instead of @at
+func runOnce(name string, at time.Time, pending bool, cb func(ctx context.Context) error, opts []CronOpts) {
 	name = "#job:" + name
 
-	intrv := interval.Milliseconds()
-	if intrv < 60000 {
-		intrv = 60000
+	c := &cronJob{
+		name: name,
+		once: true,
+		next: at.UnixMilli(),
+		opts: cronOpts(opts),
+		cb: cb,
 	}
 
-	now := time.Now().UnixMilli()
+	if state, ok := cronLoad(name); ok {
+		// the job already ran, and should not run again
+		if !state.LastRun.IsZero() && !state.LastRun.Before(at) {
+			return
+		}
+
+		// a RunAfter job already finished before a restart
+		// (@at moves with every restart, so it cannot be compared with the last run)
+		if pending && !state.LastRun.IsZero() && state.NextRun.IsZero() {
+			return
+		}
+
+		if pending && state.LastRun.IsZero() && !state.NextRun.IsZero() {
+			c.next = state.NextRun.UnixMilli()
+		}
+	}
 
+	cronMU.Lock()
+	cronAdd(c)
+	cronMU.Unlock()
+
+	cronSave(c)
+}
+
+// RunAt adds or overwrites a named job that only runs once at @at
+//
+// if @at is in the past, the job runs as soon as possible.
+//
+// if a CronStore is set (see SetCronStore), a job that already ran at or after @at
+// will not be added again, so it is safe to call this again after a restart.
+//
+// the job stays in the queue (and in ListCron) until it finishes,
+// or until it runs out of retries (see CronOpts.Retries)
+//
+// @opts: optional, see CronOpts
+func RunAt(name string, at time.Time, cb func(ctx context.Context) error, opts ...CronOpts) {
+	runOnce(name, at, false, cb, opts)
+}
+
+// RunAfter adds or overwrites a named job that only runs once after @delay
+//
+// if a CronStore is set (see SetCronStore), and the job was already added before a restart,
+// it keeps its original run time, instead of waiting for @delay again.
+// A job that already finished is not added again (call DelCron first to run it again).
+//
+// @opts: optional, see CronOpts
+func RunAfter(name string, delay time.Duration, cb func(ctx context.Context) error, opts ...CronOpts) {
+	runOnce(name, clockNow().Add(delay), true, cb, opts)
+}
+
+// NewCron adds a new, unnamed cron job to the queue
+//
+// minimum interval: CronMinInterval (default: 1 minute)
+//
+// in the callback, return true to keep the job running,
+// and return false to end the job
+//
+// @opts: optional, see CronOpts
+//
+// the returned CronJob can be used to stop or inspect the job
+func NewCron(interval time.Duration, cb func() bool, opts ...CronOpts) *CronJob {
+	return newCron(interval, cronBool(cb), opts)
+}
+
+// NewCronCtx adds a new, unnamed cron job to the queue
+//
+// this works the same as NewCron, but the callback receives a context
+// that is canceled on timeout (see CronOpts.Timeout) or when StopCron gives up waiting.
+//
+// in the callback, return ErrStopCron to end the job
+func NewCronCtx(interval time.Duration, cb func(ctx context.Context) error, opts ...CronOpts) *CronJob {
+	return newCron(interval, cb, opts)
+}
+
+// CronJob is a handle to an unnamed cron job, returned by NewCron
+type CronJob struct {
+	job *cronJob
+}
+
+// Stop removes the job from the queue
+//
+// runs that are already executing are not interrupted.
+// It returns false if the job was already stopped or had ended.
+func (job *CronJob) Stop() bool {
 	cronMU.Lock()
 	defer cronMU.Unlock()
 
-	cron[name] = cronJob{
-		interval: intrv,
-		last: &now,
-		cb: cb,
+	if job.job.index == -1 {
+		return false
+	}
+
+	cronRemove(job.job)
+	return true
+}
+
+// Reset changes the interval of the job, and schedules the next run
+// for one interval from now
+//
+// if the job was stopped or had ended, it will be added back to the queue.
+// It returns false if the job was not active.
+func (job *CronJob) Reset(interval time.Duration) bool {
+	intrv := cronInterval(interval)
+
+	cronMU.Lock()
+	defer cronMU.Unlock()
+
+	c := job.job
+	c.interval = intrv
+	c.setNext(clockNow().UnixMilli() + intrv)
+	c.retry = 0
+	c.attempt = 0
+
+	if c.index == -1 {
+		cronAdd(c)
+		return false
+	}
+
+	heap.Fix(&cronQueue, c.index)
+
+	select {
+	case cronWake <- struct{}{}:
+	default:
+	}
+
+	return true
+}
+
+// RunNow runs the job as soon as possible, without changing its schedule
+//
+// It returns false if the job was stopped or had ended.
+//
+// Note: the Overlap setting of the job still applies,
+// so by default, the run is skipped if the job is already running
+func (job *CronJob) RunNow() bool {
+	cronMU.Lock()
+	defer cronMU.Unlock()
+
+	c := job.job
+	if c.index == -1 {
+		return false
+	}
+
+	c.trigger = true
+	heap.Fix(&cronQueue, c.index)
+
+	cronStart()
+
+	select {
+	case cronWake <- struct{}{}:
+	default:
+	}
+
+	return true
+}
+
+// Next returns the next time the job is scheduled to run
+//
+// a zero time is returned if the job was stopped or had ended
+func (job *CronJob) Next() time.Time {
+	cronMU.Lock()
+	defer cronMU.Unlock()
+
+	if job.job.index == -1 {
+		return time.Time{}
 	}
+	return cronTime(job.job.due())
+}
+
+// LastRun returns the last time the job started running
+//
+// a zero time is returned if the job has not run yet
+func (job *CronJob) LastRun() time.Time {
+	cronMU.Lock()
+	defer cronMU.Unlock()
+
+	return cronTime(job.job.last)
+}
+
+// SetCron adds or overwrites a named cron job
+//
+// minimum interval: CronMinInterval (default: 1 minute)
+//
+// if a CronStore is set (see SetCronStore), the last run of the job
+// is restored, so the interval continues from before a restart
+//
+// @opts: optional, see CronOpts
+func SetCron(name string, interval time.Duration, cb func() bool, opts ...CronOpts){
+	setCron(name, interval, cronBool(cb), opts)
+}
+
+// SetCronCtx adds or overwrites a named cron job
+//
+// this works the same as SetCron, but the callback receives a context
+// that is canceled on timeout (see CronOpts.Timeout) or when StopCron gives up waiting.
+//
+// in the callback, return ErrStopCron to end the job
+func SetCronCtx(name string, interval time.Duration, cb func(ctx context.Context) error, opts ...CronOpts){
+	setCron(name, interval, cb, opts)
+}
+
+// SetCronSpec adds or overwrites a named cron job that runs on a cron expression
+//
+// @spec: a standard 5 field cron expression ("minute hour day-of-month month day-of-week"),
+// an expression with a leading seconds field, or a descriptor like "@daily"
+//
+//  SetCronSpec("log-rotate", "15 3 * * *", cb) // every day at 03:15
+//  SetCronSpec("weekly-report", "0 9 * * mon", cb) // every monday at 09:00
+//
+// the expression is evaluated in CronOpts.Location (default: the servers local time zone).
+// When daylight savings time springs forward, a run in the skipped hour happens at the end of the gap,
+// and when it falls back, a run in the repeated hour only happens once.
+//
+// in the callback, return true to keep the job running,
+// and return false to end the job
+//
+// @opts: optional, see CronOpts
+func SetCronSpec(name string, spec string, cb func() bool, opts ...CronOpts) error {
+	return setCronSpec(name, spec, cronBool(cb), opts)
+}
+
+// SetCronSpecCtx adds or overwrites a named cron job that runs on a cron expression
+//
+// this works the same as SetCronSpec, but the callback receives a context
+// that is canceled on timeout (see CronOpts.Timeout) or when StopCron gives up waiting.
+//
+// in the callback, return ErrStopCron to end the job
+func SetCronSpecCtx(name string, spec string, cb func(ctx context.Context) error, opts ...CronOpts) error {
+	return setCronSpec(name, spec, cb, opts)
 }
 
 // HasCron checks if a named cron job exists
@@ -116,11 +1156,189 @@ func HasCron(name string) bool {
 }
 
 // DelCron removes a named cron job
+//
+// this also removes its saved state from the CronStore
 func DelCron(name string) {
 	name = "#job:" + name
 
+	cronMU.Lock()
+	if c, ok := cron[name]; ok {
+		cronRemove(c)
+	}
+	cronMU.Unlock()
+
+	cronForget(name)
+}
+
+// CronInfo describes the current state of a named cron job
+type CronInfo struct {
+	Name string
+
+	// Interval is the interval of the job (0 if the job uses a cron expression)
+	Interval time.Duration
+
+	// Spec is the cron expression of the job (empty if the job uses an interval)
+	Spec string
+
+	// Once is true for jobs added by RunAt and RunAfter
+	Once bool
+
+	// LastRun is the last time the job started running
+	LastRun time.Time
+
+	// NextRun is the next time the job is scheduled to run
+	NextRun time.Time
+
+	// LastDuration is how long the last run took to finish
+	LastDuration time.Duration
+
+	// LastError is the error returned by the last run (nil if it succeeded)
+	LastError error
+
+	// RunCount is the number of times the job has finished running since it was added
+	RunCount int
+
+	// Running is the number of runs currently executing
+	Running int
+
+	// Paused is true if the job was paused with PauseCron
+	Paused bool
+}
+
+// info returns the CronInfo of a job
+//
+// Note: cronMU must be locked by the caller
+func (c *cronJob) info() CronInfo {
+	name, _ := cronStoreName(c.name)
+
+	info := CronInfo{
+		Name: name,
+		Interval: time.Duration(c.interval) * time.Millisecond,
+		LastRun: cronTime(c.last),
+		NextRun: cronTime(c.due()),
+		LastDuration: c.lastDuration,
+		LastError: c.lastErr,
+		RunCount: c.runs,
+		Running: c.running,
+		Paused: c.paused,
+		Once: c.once,
+	}
+
+	if c.spec != nil {
+		info.Interval = 0
+		info.Spec = c.spec.src
+	}
+
+	return info
+}
+
+// ListCron returns the current state of every named cron job, sorted by name
+func ListCron() []CronInfo {
+	cronMU.Lock()
+	defer cronMU.Unlock()
+
+	list := []CronInfo{}
+	for name, c := range cron {
+		if _, named := cronStoreName(name); named {
+			list = append(list, c.info())
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+
+	return list
+}
+
+// GetCron returns the current state of a named cron job
+func GetCron(name string) (CronInfo, bool) {
+	name = "#job:" + name
+
+	cronMU.Lock()
+	defer cronMU.Unlock()
+
+	if c, ok := cron[name]; ok {
+		return c.info(), true
+	}
+	return CronInfo{}, false
+}
+
+// RunCronNow runs a named cron job as soon as possible, without changing its schedule
+//
+// this also works while the job is paused.
+//
+// Note: the Overlap setting of the job still applies,
+// so by default, the run is skipped if the job is already running
+func RunCronNow(name string) error {
+	name = "#job:" + name
+
+	cronMU.Lock()
+	defer cronMU.Unlock()
+
+	c, ok := cron[name]
+	if !ok {
+		return ErrCronNotFound
+	}
+
+	c.trigger = true
+	heap.Fix(&cronQueue, c.index)
+
+	cronStart()
+
+	select {
+	case cronWake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// PauseCron stops a named cron job from running on its schedule, until ResumeCron is called
+//
+// runs that are already executing are not interrupted
+func PauseCron(name string) error {
+	name = "#job:" + name
+
 	cronMU.Lock()
 	defer cronMU.Unlock()
 
-	delete(cron, name)
+	c, ok := cron[name]
+	if !ok {
+		return ErrCronNotFound
+	}
+
+	c.paused = true
+	return nil
+}
+
+// ResumeCron resumes a named cron job that was paused with PauseCron
+func ResumeCron(name string) error {
+	name = "#job:" + name
+
+	cronMU.Lock()
+	defer cronMU.Unlock()
+
+	c, ok := cron[name]
+	if !ok {
+		return ErrCronNotFound
+	}
+
+	c.paused = false
+
+	// a one time job that came due while it was paused runs now
+	// (it is kept in the queue until it finishes, so it was not removed)
+	if c.once && c.next == cronNever && c.running == 0 && c.retry == 0 && !c.queued {
+		c.setNext(c.slot)
+		heap.Fix(&cronQueue, c.index)
+
+		cronStart()
+
+		select {
+		case cronWake <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
 }
@@ -0,0 +1,170 @@
+package webext
+
+import (
+	"bytes"
+	"errors"
+	"html/template"
+	"time"
+
+	"github.com/AspieSoft/goutil/v7"
+	"github.com/gofiber/fiber/v2"
+)
+
+type cronAdminJob struct {
+	Name string `json:"name"`
+	Interval string `json:"interval,omitempty"`
+	Spec string `json:"spec,omitempty"`
+	Once bool `json:"once"`
+	LastRun *time.Time `json:"last_run"`
+	NextRun *time.Time `json:"next_run"`
+	LastDuration string `json:"last_duration"`
+	LastError string `json:"last_error,omitempty"`
+	RunCount int `json:"run_count"`
+	Running int `json:"running"`
+	Paused bool `json:"paused"`
+}
+
+var cronAdminTemplate *template.Template = template.Must(template.New("cron").Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8"/>
+	<title>Cron Jobs</title>
+	<style>
+		body{font-family: sans-serif;}
+		table{border-collapse: collapse;}
+		th, td{padding: 4px 8px; border: 1px solid #ccc; text-align: left;}
+		form{display: inline;}
+		.error{color: #c00;}
+	</style>
+</head>
+<body>
+	<h1>Cron Jobs</h1>
+	<table>
+		<tr>
+			<th>Name</th><th>Schedule</th><th>Last Run</th><th>Next Run</th><th>Duration</th>
+			<th>Runs</th><th>Status</th><th>Last Error</th><th>Actions</th>
+		</tr>
+		{{range .}}
+		<tr>
+			<td>{{.Name}}</td>
+			<td>{{if .Spec}}{{.Spec}}{{else if .Once}}once{{else}}every {{.Interval}}{{end}}</td>
+			<td>{{if .LastRun}}{{.LastRun.Format "2006-01-02 15:04:05 MST"}}{{else}}-{{end}}</td>
+			<td>{{if .NextRun}}{{.NextRun.Format "2006-01-02 15:04:05 MST"}}{{else}}-{{end}}</td>
+			<td>{{.LastDuration}}</td>
+			<td>{{.RunCount}}</td>
+			<td>{{if .Running}}running{{else if .Paused}}paused{{else}}waiting{{end}}</td>
+			<td class="error">{{.LastError}}</td>
+			<td>
+				<form method="POST"><input type="hidden" name="name" value="{{.Name}}"/><input type="hidden" name="action" value="run"/><button>Run Now</button></form>
+				{{if .Paused}}
+				<form method="POST"><input type="hidden" name="name" value="{{.Name}}"/><input type="hidden" name="action" value="resume"/><button>Resume</button></form>
+				{{else}}
+				<form method="POST"><input type="hidden" name="name" value="{{.Name}}"/><input type="hidden" name="action" value="pause"/><button>Pause</button></form>
+				{{end}}
+				<form method="POST" onsubmit="return confirm('Delete {{.Name}}?')"><input type="hidden" name="name" value="{{.Name}}"/><input type="hidden" name="action" value="delete"/><button>Delete</button></form>
+			</td>
+		</tr>
+		{{else}}
+		<tr><td colspan="9">No named cron jobs</td></tr>
+		{{end}}
+	</table>
+</body>
+</html>
+`))
+
+// CronAdmin returns a handler that shows the current named cron jobs (see ListCron),
+// and allows triggering, pausing, resuming and deleting them.
+//
+// GET requests return an html page, or json if the client accepts "application/json"
+// (or if the "format=json" query is set).
+//
+// POST requests take an "action" ("run", "pause", "resume" or "delete")
+// and the "name" of the job.
+//
+// Notice: This handler allows anyone who can reach it to control your cron jobs.
+// It should only be added behind VerifyLogin, an IP allowlist, or something similar.
+//
+//  app.All("/admin/cron", webext.VerifyLogin(), webext.CronAdmin())
+func CronAdmin() func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		asJSON := goutil.Clean.Str(c.Query("format")) == "json" || c.Accepts("text/html", "application/json") == "application/json"
+
+		if c.Method() == "POST" {
+			name := goutil.Clean.Str(c.FormValue("name"))
+			action := goutil.Clean.Str(c.FormValue("action"))
+
+			var err error
+			switch action {
+			case "run":
+				err = RunCronNow(name)
+			case "pause":
+				err = PauseCron(name)
+			case "resume":
+				err = ResumeCron(name)
+			case "delete":
+				if HasCron(name) {
+					DelCron(name)
+				}else{
+					err = ErrCronNotFound
+				}
+			default:
+				c.SendStatus(400)
+				return c.SendString("Invalid Action: "+action)
+			}
+
+			if errors.Is(err, ErrCronNotFound) {
+				c.SendStatus(404)
+				return c.SendString("Cron Job Not Found: "+name)
+			}else if err != nil {
+				c.SendStatus(500)
+				return c.SendString(err.Error())
+			}
+
+			if asJSON {
+				return c.JSON(map[string]interface{}{"ok": true})
+			}
+			return c.Redirect(goutil.Clean.Str(c.OriginalURL()), 303)
+		}
+
+		list := []cronAdminJob{}
+		for _, info := range ListCron() {
+			job := cronAdminJob{
+				Name: info.Name,
+				Spec: info.Spec,
+				Once: info.Once,
+				LastDuration: info.LastDuration.String(),
+				RunCount: info.RunCount,
+				Running: info.Running,
+				Paused: info.Paused,
+			}
+
+			if info.Interval != 0 {
+				job.Interval = info.Interval.String()
+			}
+			if !info.LastRun.IsZero() {
+				job.LastRun = &info.LastRun
+			}
+			if !info.NextRun.IsZero() {
+				job.NextRun = &info.NextRun
+			}
+			if info.LastError != nil {
+				job.LastError = info.LastError.Error()
+			}
+
+			list = append(list, job)
+		}
+
+		if asJSON {
+			return c.JSON(list)
+		}
+
+		buf := bytes.Buffer{}
+		if err := cronAdminTemplate.Execute(&buf, list); err != nil {
+			c.SendStatus(500)
+			return c.SendString(err.Error())
+		}
+
+		c.Set("Content-Type", "text/html; charset=utf-8")
+		return c.Send(buf.Bytes())
+	}
+}
@@ -0,0 +1,351 @@
+package webext
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// CronLocker makes sure that each scheduled run of a named cron job
+// only executes on one instance, when multiple instances of your app are running.
+//
+// The lock is a lease: the instance that runs the job renews it while the job is running,
+// and if that instance dies mid-job, the lease expires and another instance can take over.
+//
+// You can implement this interface to use your own database, and enable it with SetCronLocker.
+type CronLocker interface {
+	// Acquire tries to take the lease for the run of job @name that was scheduled at @slot.
+	//
+	// @owner: a unique id of the instance trying to run the job
+	//
+	// @ttl: how long the lease is valid for, unless it is renewed
+	//
+	// @return
+	//
+	// @lease: return a lease if this instance should run the job.
+	//
+	// @retry: if another instance holds an active lease for this run, return a nil lease
+	// and the time that lease expires, so this instance can try to take over if it is not renewed.
+	// If the run was already done (by any instance, including this one), return a nil lease and a zero time.
+	Acquire(name string, owner string, slot time.Time, ttl time.Duration) (lease CronLease, retry time.Time, err error)
+}
+
+// CronLease is a lease returned by CronLocker.Acquire
+type CronLease interface {
+	// Renew extends the lease by @ttl from now.
+	// It should return ErrCronLeaseLost if another instance took over the lease.
+	Renew(ttl time.Duration) error
+
+	// Release marks the run as done
+	Release() error
+}
+
+// ErrCronLeaseLost is returned when a cron lease was taken over by another instance
+var ErrCronLeaseLost error = errors.New("cron: lease lost")
+
+var cronLocker CronLocker
+
+// cronOwner is the id of this instance, used by the CronLocker (see SetCronOwner)
+var cronOwner string
+var cronDefaultOwner string
+
+func init(){
+	host, _ := os.Hostname()
+
+	b := make([]byte, 8)
+	rand.Read(b)
+
+	cronDefaultOwner = host+"-"+strconv.Itoa(os.Getpid())+"-"+hex.EncodeToString(b)
+	cronOwner = cronDefaultOwner
+}
+
+// SetCronOwner sets the unique id of this instance, used by the CronLocker.
+// Set it to an empty string to go back to the default.
+//
+// It should be called before adding your jobs.
+//
+// default: hostname-pid-random
+func SetCronOwner(owner string) {
+	cronMU.Lock()
+	defer cronMU.Unlock()
+
+	if owner == "" {
+		owner = cronDefaultOwner
+	}
+	cronOwner = owner
+}
+
+// SetCronLocker enables running named cron jobs on only one instance at a time.
+// Set it to nil to disable it (default).
+//
+// It should be called before adding your jobs.
+//
+// Note: when a CronLocker is set, interval jobs are aligned to multiples of their interval
+// (since the unix epoch), so every instance schedules the same runs.
+//
+//  webext.SetCronLocker(webext.NewFileCronLocker("/mnt/shared/cron"))
+func SetCronLocker(locker CronLocker) {
+	cronMU.Lock()
+	defer cronMU.Unlock()
+
+	cronLocker = locker
+}
+
+// cronLeaseData is the state of a lease, shared by the file and memory lockers
+type cronLeaseData struct {
+	Owner string `json:"owner"`
+	Slot int64 `json:"slot"`
+	Expires int64 `json:"expires"`
+	Done bool `json:"done"`
+}
+
+// acquire decides if @owner can take the lease for @slot
+//
+// @exists: false if no lease was saved for the job yet
+func (l cronLeaseData) acquire(exists bool, owner string, slot int64, now int64) (ok bool, retry int64) {
+	if !exists {
+		return true, 0
+	}
+
+	if l.Slot == slot && l.Done {
+		// the run is done, even if this instance ran it (i.e. before a restart)
+		return false, 0
+	}
+
+	if l.Owner == owner {
+		return true, 0
+	}
+
+	if l.Slot > slot {
+		// a newer run already started on another instance
+		return false, 0
+	}
+
+	if l.Slot == slot {
+		if now < l.Expires {
+			return false, l.Expires
+		}
+
+		// the other instance stopped renewing the lease, so we take over
+		return true, 0
+	}
+
+	if !l.Done && now < l.Expires {
+		// an older run is still running on another instance
+		return false, 0
+	}
+
+	return true, 0
+}
+
+type fileCronLocker struct {
+	dir string
+}
+
+type fileCronLease struct {
+	locker *fileCronLocker
+	name string
+	owner string
+	slot int64
+}
+
+// NewFileCronLocker returns a CronLocker that stores leases as files in @dir
+//
+// @dir should be on a volume shared by every instance (default: PWD/cron.lock)
+func NewFileCronLocker(dir string) CronLocker {
+	if dir == "" {
+		dir = filepath.Join(PWD, "cron.lock")
+	}
+
+	return &fileCronLocker{dir: dir}
+}
+
+// path returns the lease file of a job
+func (locker *fileCronLocker) path(name string) string {
+	return filepath.Join(locker.dir, url.PathEscape(name)+".lease")
+}
+
+// update runs @cb while holding an exclusive lock on the lease file of a job,
+// and saves the lease if @cb returns true
+func (locker *fileCronLocker) update(name string, cb func(l *cronLeaseData, exists bool) bool) error {
+	path := locker.path(name)
+
+	// the lock file is locked by the os, so only one instance can update the lease at a time,
+	// and the lock is released if an instance crashes
+	unlock, err := lockFile(path+".lock", 5 * time.Second)
+	if err != nil {
+		return errors.New("cron: "+err.Error())
+	}
+	defer unlock()
+
+	l := cronLeaseData{}
+	exists := false
+
+	buf, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}else if err == nil && len(buf) != 0 {
+		if err := json.Unmarshal(buf, &l); err != nil {
+			return err
+		}
+		exists = true
+	}
+
+	if !cb(&l, exists) {
+		return nil
+	}
+
+	buf, err = json.Marshal(l)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(path+".tmp", buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (locker *fileCronLocker) Acquire(name string, owner string, slot time.Time, ttl time.Duration) (CronLease, time.Time, error) {
+	now := clockNow().UnixMilli()
+	slotMS := slot.UnixMilli()
+
+	var ok bool
+	var retry int64
+
+	err := locker.update(name, func(l *cronLeaseData, exists bool) bool {
+		ok, retry = l.acquire(exists, owner, slotMS, now)
+		if !ok {
+			return false
+		}
+
+		*l = cronLeaseData{
+			Owner: owner,
+			Slot: slotMS,
+			Expires: now + ttl.Milliseconds(),
+		}
+		return true
+	})
+
+	if err != nil || !ok {
+		return nil, cronTime(retry), err
+	}
+
+	return &fileCronLease{locker: locker, name: name, owner: owner, slot: slotMS}, time.Time{}, nil
+}
+
+func (lease *fileCronLease) Renew(ttl time.Duration) error {
+	lost := false
+
+	err := lease.locker.update(lease.name, func(l *cronLeaseData, exists bool) bool {
+		if !exists || l.Owner != lease.owner || l.Slot != lease.slot {
+			lost = true
+			return false
+		}
+
+		l.Expires = clockNow().UnixMilli() + ttl.Milliseconds()
+		return true
+	})
+
+	if err == nil && lost {
+		return ErrCronLeaseLost
+	}
+	return err
+}
+
+func (lease *fileCronLease) Release() error {
+	return lease.locker.update(lease.name, func(l *cronLeaseData, exists bool) bool {
+		if !exists || l.Owner != lease.owner || l.Slot != lease.slot {
+			return false
+		}
+
+		l.Done = true
+		return true
+	})
+}
+
+// MemoryCronLocker is an in-process CronLocker.
+//
+// It does not coordinate between processes. The scheduler always acquires leases
+// as this instance (see SetCronOwner), so in tests, another instance can be simulated
+// by calling Acquire directly with a different owner.
+type MemoryCronLocker struct {
+	leases map[string]cronLeaseData
+	mu sync.Mutex
+}
+
+type memoryCronLease struct {
+	locker *MemoryCronLocker
+	name string
+	owner string
+	slot int64
+}
+
+// NewMemoryCronLocker returns an in-process CronLocker
+func NewMemoryCronLocker() *MemoryCronLocker {
+	return &MemoryCronLocker{leases: map[string]cronLeaseData{}}
+}
+
+func (locker *MemoryCronLocker) Acquire(name string, owner string, slot time.Time, ttl time.Duration) (CronLease, time.Time, error) {
+	now := clockNow().UnixMilli()
+	slotMS := slot.UnixMilli()
+
+	locker.mu.Lock()
+	defer locker.mu.Unlock()
+
+	l, exists := locker.leases[name]
+	if ok, retry := l.acquire(exists, owner, slotMS, now); !ok {
+		return nil, cronTime(retry), nil
+	}
+
+	locker.leases[name] = cronLeaseData{
+		Owner: owner,
+		Slot: slotMS,
+		Expires: now + ttl.Milliseconds(),
+	}
+
+	return &memoryCronLease{locker: locker, name: name, owner: owner, slot: slotMS}, time.Time{}, nil
+}
+
+func (lease *memoryCronLease) Renew(ttl time.Duration) error {
+	lease.locker.mu.Lock()
+	defer lease.locker.mu.Unlock()
+
+	l, ok := lease.locker.leases[lease.name]
+	if !ok || l.Owner != lease.owner || l.Slot != lease.slot {
+		return ErrCronLeaseLost
+	}
+
+	l.Expires = clockNow().UnixMilli() + ttl.Milliseconds()
+	lease.locker.leases[lease.name] = l
+	return nil
+}
+
+func (lease *memoryCronLease) Release() error {
+	lease.locker.mu.Lock()
+	defer lease.locker.mu.Unlock()
+
+	l, ok := lease.locker.leases[lease.name]
+	if !ok || l.Owner != lease.owner || l.Slot != lease.slot {
+		return nil
+	}
+
+	l.Done = true
+	lease.locker.leases[lease.name] = l
+	return nil
+}
+
+// lockTTL returns the ttl of the lease of a job
+func (opts CronOpts) lockTTL() time.Duration {
+	if opts.LockTTL > 0 {
+		return opts.LockTTL
+	}
+	return 1 * time.Minute
+}
@@ -0,0 +1,289 @@
+package webext
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSpec is a parsed cron expression
+//
+// each field is stored as a bit set of the values it allows
+type cronSpec struct {
+	// src is the original expression
+	src string
+
+	second uint64
+	minute uint64
+	hour uint64
+	dom uint64
+	month uint64
+	dow uint64
+
+	// domStar and dowStar are used to decide if the day of month
+	// and day of week fields should be combined with `and` or `or`
+	domStar bool
+	dowStar bool
+}
+
+type cronSpecField struct {
+	min int
+	max int
+	names map[string]int
+}
+
+var cronSpecSecond = cronSpecField{0, 59, nil}
+var cronSpecMinute = cronSpecField{0, 59, nil}
+var cronSpecHour = cronSpecField{0, 23, nil}
+var cronSpecDom = cronSpecField{1, 31, nil}
+var cronSpecMonth = cronSpecField{1, 12, map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}}
+var cronSpecDow = cronSpecField{0, 7, map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}}
+
+var cronSpecDescriptors = map[string]string{
+	"@yearly": "0 0 0 1 1 *",
+	"@annually": "0 0 0 1 1 *",
+	"@monthly": "0 0 0 1 * *",
+	"@weekly": "0 0 0 * * 0",
+	"@daily": "0 0 0 * * *",
+	"@midnight": "0 0 0 * * *",
+	"@hourly": "0 0 * * * *",
+}
+
+// parseCronSpec parses a cron expression
+//
+// accepted formats:
+//  - "minute hour day-of-month month day-of-week"
+//  - "second minute hour day-of-month month day-of-week"
+//  - "@yearly", "@annually", "@monthly", "@weekly", "@daily", "@midnight", "@hourly"
+//
+// each field accepts `*`, `?`, values, ranges (`1-5`), steps (`*/15`, `0-30/5`)
+// and comma separated lists of those. Months and weekdays also accept
+// their 3 letter names (`jan`, `mon`), and 7 is also treated as sunday.
+func parseCronSpec(spec string) (*cronSpec, error) {
+	spec = strings.TrimSpace(spec)
+	src := spec
+
+	if strings.HasPrefix(spec, "@") {
+		desc, ok := cronSpecDescriptors[strings.ToLower(spec)]
+		if !ok {
+			return nil, errors.New("cron: unknown descriptor: "+spec)
+		}
+		spec = desc
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) == 5 {
+		fields = append([]string{"0"}, fields...)
+	}else if len(fields) != 6 {
+		return nil, errors.New("cron: expected 5 or 6 fields, found "+strconv.Itoa(len(fields))+": "+spec)
+	}
+
+	s := cronSpec{src: src}
+	var err error
+
+	if s.second, err = cronSpecSecond.parse(fields[0]); err != nil {
+		return nil, err
+	}
+	if s.minute, err = cronSpecMinute.parse(fields[1]); err != nil {
+		return nil, err
+	}
+	if s.hour, err = cronSpecHour.parse(fields[2]); err != nil {
+		return nil, err
+	}
+	if s.dom, err = cronSpecDom.parse(fields[3]); err != nil {
+		return nil, err
+	}
+	if s.month, err = cronSpecMonth.parse(fields[4]); err != nil {
+		return nil, err
+	}
+	if s.dow, err = cronSpecDow.parse(fields[5]); err != nil {
+		return nil, err
+	}
+
+	// sunday can be either 0 or 7
+	if s.dow & (1 << 7) != 0 {
+		s.dow |= 1
+	}
+
+	s.domStar = fields[3] == "*" || fields[3] == "?"
+	s.dowStar = fields[5] == "*" || fields[5] == "?"
+
+	return &s, nil
+}
+
+// parse converts a single cron field into a bit set
+func (f cronSpecField) parse(field string) (uint64, error) {
+	var bits uint64
+
+	for _, part := range strings.Split(strings.ToLower(field), ",") {
+		step := 1
+		if i := strings.IndexByte(part, '/'); i != -1 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, errors.New("cron: invalid step: "+field)
+			}
+			step = n
+			part = part[:i]
+		}
+
+		var start, end int
+		if part == "*" || part == "?" {
+			start, end = f.min, f.max
+		}else if i := strings.IndexByte(part, '-'); i != -1 {
+			var err error
+			if start, err = f.value(part[:i]); err != nil {
+				return 0, err
+			}
+			if end, err = f.value(part[i+1:]); err != nil {
+				return 0, err
+			}
+		}else{
+			var err error
+			if start, err = f.value(part); err != nil {
+				return 0, err
+			}
+
+			// "5/15" means every 15 starting at 5
+			end = start
+			if step != 1 {
+				end = f.max
+			}
+		}
+
+		if start < f.min || end > f.max || start > end {
+			return 0, errors.New("cron: value out of range: "+field)
+		}
+
+		for i := start; i <= end; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+
+	return bits, nil
+}
+
+// value converts a single number or name into its numeric value
+func (f cronSpecField) value(val string) (int, error) {
+	if f.names != nil {
+		if n, ok := f.names[val]; ok {
+			return n, nil
+		}
+	}
+
+	n, err := strconv.Atoi(val)
+	if err != nil {
+		return 0, errors.New("cron: invalid value: "+val)
+	}
+	return n, nil
+}
+
+// dayMatch checks if the day of month and day of week fields allow a date
+//
+// if both fields are restricted, the date only needs to match one of them
+// (this is the same behavior as the standard cron)
+func (s *cronSpec) dayMatch(t time.Time) bool {
+	domMatch := s.dom & (1 << uint(t.Day())) != 0
+	dowMatch := s.dow & (1 << uint(t.Weekday())) != 0
+
+	if s.domStar || s.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// next returns the first time after @t that matches the cron expression
+//
+// the expression is evaluated in the location of @t.
+// If no time matches within the next 5 years, a zero time is returned.
+//
+// daylight savings time is handled by matching wall clock times:
+//  - when the clock springs forward, a time that was skipped runs at the end of the gap
+//  - when the clock falls back, a time that happens twice only runs the first time
+func (s *cronSpec) next(t time.Time) time.Time {
+	loc := t.Location()
+
+	// search in wall clock time (using UTC, which has no daylight savings),
+	// and convert each match back to @loc
+	wall := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+
+	for {
+		wall = s.nextWall(wall)
+		if wall.IsZero() {
+			return time.Time{}
+		}
+
+		// in a fall back, the wall clock time may have already passed
+		if next := cronWallTime(wall, loc); next.After(t) {
+			return next
+		}
+	}
+}
+
+// nextWall returns the first wall clock time after @t that matches the cron expression
+//
+// @t must be in UTC
+func (s *cronSpec) nextWall(t time.Time) time.Time {
+	t = t.Truncate(time.Second).Add(time.Second)
+
+	yearLimit := t.Year() + 5
+	for t.Year() <= yearLimit {
+		if s.month & (1 << uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+
+		if !s.dayMatch(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+
+		if s.hour & (1 << uint(t.Hour())) == 0 {
+			t = t.Truncate(time.Hour).Add(time.Hour)
+			continue
+		}
+
+		if s.minute & (1 << uint(t.Minute())) == 0 {
+			t = t.Truncate(time.Minute).Add(time.Minute)
+			continue
+		}
+
+		if s.second & (1 << uint(t.Second())) == 0 {
+			t = t.Add(time.Second)
+			continue
+		}
+
+		return t
+	}
+
+	return time.Time{}
+}
+
+// cronWallTime converts a wall clock time into @loc
+//
+// if the wall clock time was skipped by daylight savings time,
+// the time the clock jumped to is returned instead.
+// If the wall clock time happens twice, the first one is returned.
+func cronWallTime(wall time.Time, loc *time.Location) time.Time {
+	t := time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour(), wall.Minute(), wall.Second(), 0, loc)
+	if t.Day() == wall.Day() && t.Hour() == wall.Hour() && t.Minute() == wall.Minute() {
+		return t
+	}
+
+	// find the end of the gap
+	wall = wall.Truncate(time.Minute)
+	for i := 0; i < 24 * 60; i++ {
+		wall = wall.Add(time.Minute)
+		t = time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour(), wall.Minute(), 0, 0, loc)
+		if t.Day() == wall.Day() && t.Hour() == wall.Hour() && t.Minute() == wall.Minute() {
+			return t
+		}
+	}
+
+	return t
+}
@@ -0,0 +1,273 @@
+package webext
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CronState is the saved state of a named cron job
+type CronState struct {
+	// LastRun is the last time the job started running
+	LastRun time.Time `json:"last_run"`
+
+	// NextRun is the next time the job is due
+	NextRun time.Time `json:"next_run"`
+}
+
+// CronStore saves the state of named cron jobs, so it can be restored
+// when the job is added again after a restart.
+//
+// You can implement this interface to store the state in your own database,
+// and enable it with SetCronStore.
+type CronStore interface {
+	// Load returns the saved state of a job.
+	// Return false if no state was saved for that job.
+	Load(name string) (state CronState, ok bool, err error)
+
+	// Save stores the state of a job
+	Save(name string, state CronState) error
+
+	// Delete removes the saved state of a job
+	Delete(name string) error
+}
+
+var cronStore CronStore
+
+// SetCronStore enables saving the state of named cron jobs.
+// Set it to nil to disable it (default).
+//
+// It should be called before adding your jobs, so their state
+// can be restored by SetCron and SetCronSpec.
+//
+//  webext.SetCronStore(webext.NewFileCronStore(""))
+func SetCronStore(store CronStore) {
+	cronMU.Lock()
+	defer cronMU.Unlock()
+
+	cronStore = store
+}
+
+type fileCronStore struct {
+	path string
+	jobs map[string]CronState
+	mu sync.Mutex
+}
+
+// NewFileCronStore returns a CronStore that saves the state of all jobs in a json file
+//
+// @path: file path to store the state in (default: PWD/cron.json)
+func NewFileCronStore(path string) CronStore {
+	if path == "" {
+		path = filepath.Join(PWD, "cron.json")
+	}
+
+	return &fileCronStore{path: path}
+}
+
+// load reads the file the first time it is needed
+//
+// Note: mu must be locked by the caller
+func (store *fileCronStore) load() error {
+	if store.jobs != nil {
+		return nil
+	}
+
+	jobs := map[string]CronState{}
+
+	buf, err := os.ReadFile(store.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}else if err == nil && len(buf) != 0 {
+		if err := json.Unmarshal(buf, &jobs); err != nil {
+			return err
+		}
+	}
+
+	store.jobs = jobs
+	return nil
+}
+
+// write saves the file, using a temp file to avoid corrupting it on a crash
+//
+// Note: mu must be locked by the caller
+func (store *fileCronStore) write() error {
+	buf, err := json.MarshalIndent(store.jobs, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	os.MkdirAll(filepath.Dir(store.path), TryPerm(0644, 0755))
+
+	if err := os.WriteFile(store.path+".tmp", buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(store.path+".tmp", store.path)
+}
+
+func (store *fileCronStore) Load(name string) (CronState, bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if err := store.load(); err != nil {
+		return CronState{}, false, err
+	}
+
+	state, ok := store.jobs[name]
+	return state, ok, nil
+}
+
+func (store *fileCronStore) Save(name string, state CronState) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if err := store.load(); err != nil {
+		return err
+	}
+
+	store.jobs[name] = state
+	return store.write()
+}
+
+func (store *fileCronStore) Delete(name string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if err := store.load(); err != nil {
+		return err
+	}
+
+	if _, ok := store.jobs[name]; !ok {
+		return nil
+	}
+
+	delete(store.jobs, name)
+	return store.write()
+}
+
+// cronStoreName returns the name a job is saved as,
+// or false if the job is unnamed and should not be saved
+func cronStoreName(name string) (string, bool) {
+	if !strings.HasPrefix(name, "#job:") {
+		return "", false
+	}
+	return strings.TrimPrefix(name, "#job:"), true
+}
+
+// cronLoad loads the saved state of a named job
+func cronLoad(name string) (CronState, bool) {
+	cronMU.Lock()
+	store := cronStore
+	cronMU.Unlock()
+
+	key, named := cronStoreName(name)
+	if store == nil || !named {
+		return CronState{}, false
+	}
+
+	state, ok, err := store.Load(key)
+	if err != nil {
+		PrintMsg(`error`, "Cron Store Error: "+err.Error(), 50, true)
+		return CronState{}, false
+	}
+	return state, ok
+}
+
+// cronSave saves the current state of a named job
+func cronSave(c *cronJob) {
+	cronMU.Lock()
+	store := cronStore
+	state := CronState{
+		LastRun: cronTime(c.last),
+		NextRun: cronTime(c.next),
+	}
+	cronMU.Unlock()
+
+	key, named := cronStoreName(c.name)
+	if store == nil || !named {
+		return
+	}
+
+	if err := store.Save(key, state); err != nil {
+		PrintMsg(`error`, "Cron Store Error: "+err.Error(), 50, true)
+	}
+}
+
+// cronSaveDone saves the state of a one time job that finished
+func cronSaveDone(c *cronJob) {
+	cronMU.Lock()
+	store := cronStore
+	state := CronState{
+		LastRun: cronTime(c.last),
+	}
+	cronMU.Unlock()
+
+	key, named := cronStoreName(c.name)
+	if store == nil || !named {
+		return
+	}
+
+	if err := store.Save(key, state); err != nil {
+		PrintMsg(`error`, "Cron Store Error: "+err.Error(), 50, true)
+	}
+}
+
+// cronForget removes the saved state of a named job
+func cronForget(name string) {
+	cronMU.Lock()
+	store := cronStore
+	cronMU.Unlock()
+
+	key, named := cronStoreName(name)
+	if store == nil || !named {
+		return
+	}
+
+	if err := store.Delete(key); err != nil {
+		PrintMsg(`error`, "Cron Store Error: "+err.Error(), 50, true)
+	}
+}
+
+// restore applies a saved state to a new job
+//
+// the saved run times are kept, so a job that is added again after a restart
+// will continue from where it left off, instead of starting a new interval.
+// If the job was due while the process was down, and CronOpts.CatchUp is true,
+// it will run as soon as possible.
+func (c *cronJob) restore(state CronState, now int64) {
+	if !state.LastRun.IsZero() {
+		c.last = state.LastRun.UnixMilli()
+	}
+
+	if state.NextRun.IsZero() {
+		return
+	}
+
+	next := state.NextRun.UnixMilli()
+
+	if c.spec != nil {
+		if next <= now && c.opts.CatchUp {
+			c.next = now
+		}
+		return
+	}
+
+	// the interval may have been shortened since the state was saved
+	if next > now + c.interval {
+		next = now + c.interval
+	}
+
+	if next <= now {
+		if c.opts.CatchUp {
+			next = now
+		}else{
+			// skip the missed runs, but keep the same interval offset
+			next += ((now - next) / c.interval + 1) * c.interval
+		}
+	}
+
+	c.next = next
+}
@@ -0,0 +1,52 @@
+package webext
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// lockFile takes an exclusive advisory lock on the file at @path,
+// that is shared by every process using the same file (i.e. multiple instances on a shared volume)
+//
+// the file is created if it does not exist, and is never removed,
+// so the lock is always taken on the same file.
+// The os releases the lock if the process crashes, so a lock is never left behind.
+//
+// @timeout: how long to wait for another process to release the lock
+//
+// Note: the lock is not reentrant
+func lockFile(path string, timeout time.Duration) (unlock func(), err error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if os.IsNotExist(err) {
+		// only create the directory the first time, since TryPerm touches the disk
+		os.MkdirAll(filepath.Dir(path), TryPerm(0644, 0755))
+		file, err = os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	for {
+		ok, err := tryLockFile(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}else if ok {
+			break
+		}
+
+		if time.Since(start) > timeout {
+			file.Close()
+			return nil, errors.New("timed out waiting for lock: "+path)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return func(){
+		unlockFile(file)
+		file.Close()
+	}, nil
+}
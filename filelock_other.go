@@ -0,0 +1,34 @@
+//go:build !unix && !windows
+
+package webext
+
+import (
+	"os"
+	"sync"
+)
+
+var otherFileLocks map[string]bool = map[string]bool{}
+var otherFileLocksMU sync.Mutex
+
+// tryLockFile takes an exclusive lock on @file, without waiting
+//
+// file locks are not supported on this os, so this only locks within the current process
+func tryLockFile(file *os.File) (bool, error) {
+	otherFileLocksMU.Lock()
+	defer otherFileLocksMU.Unlock()
+
+	if otherFileLocks[file.Name()] {
+		return false, nil
+	}
+	otherFileLocks[file.Name()] = true
+	return true, nil
+}
+
+// unlockFile releases the lock on @file
+func unlockFile(file *os.File) error {
+	otherFileLocksMU.Lock()
+	defer otherFileLocksMU.Unlock()
+
+	delete(otherFileLocks, file.Name())
+	return nil
+}
@@ -10,6 +10,8 @@ require (
 	github.com/AspieSoft/goutil/syncmap v0.0.0-20240421130826-c9ff7038cd70
 	github.com/AspieSoft/goutil/v7 v7.8.0
 	github.com/gofiber/fiber/v2 v2.52.4
+	golang.org/x/crypto v0.22.0
+	golang.org/x/sys v0.19.0
 )
 
 require (
@@ -24,6 +26,5 @@ require (
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
 	github.com/valyala/fasthttp v1.52.0 // indirect
 	github.com/valyala/tcplisten v1.0.0 // indirect
-	golang.org/x/sys v0.19.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -25,6 +25,25 @@ type hookList struct {
 	//
 	// By default, this returns a hash of the users IP Address (RemoteAddr) and UserAgent.
 	GetPCID func(c *fiber.Ctx) string
+
+	// OnCronError is a method you can override.
+	//
+	// This method is called when a cron job returns an error or panics.
+	// If the job has retries (see CronOpts.Retries), it is called for every failed attempt.
+	//
+	// @name: the name of the job (this is empty for unnamed jobs)
+	//
+	// By default, this prints the error to the console.
+	OnCronError func(name string, err error)
+
+	// OnTLSError is a method you can override.
+	//
+	// This method is called when the https listener of ListenAutoTLS fails (i.e. the port is in use).
+	// The listener is retried with a backoff (see TLSRetryDelay), and while it is down,
+	// RedirectSSL stops redirecting to https.
+	//
+	// By default, this prints the error to the console.
+	OnTLSError func(err error)
 }
 
 type hookListLoginForm struct {
@@ -46,7 +46,7 @@ func init(){
 	if Hooks.LoginForm.CreateSession == nil {
 		Hooks.LoginForm.CreateSession = func(uuid string) (token string, exp time.Time, err error) {
 			// add user session to database
-			return string(crypt.RandBytes(256)), time.Now().Add(-24 * time.Hour), errors.New("500:Create Session Method Needs Setup!") // expire now
+			return string(crypt.RandBytes(256)), clockNow().Add(-24 * time.Hour), errors.New("500:Create Session Method Needs Setup!") // expire now
 		}
 	}
 
@@ -111,7 +111,7 @@ func VerifyLogin() func(c *fiber.Ctx) error {
 			}
 
 			formToken := goutil.Clean.Str(c.FormValue("session"))
-			if session, ok := formSession.Get(formToken); ok && session.pcid == Hooks.GetPCID(c) && time.Now().UnixMilli() < session.exp.UnixMilli() {
+			if session, ok := formSession.Get(formToken); ok && session.pcid == Hooks.GetPCID(c) && clockNow().UnixMilli() < session.exp.UnixMilli() {
 				formSession.Del(formToken)
 				if formCookie := goutil.Clean.Str(c.Cookies("form_session")); formCookie == session.cookie {
 					c.ClearCookie("form_session")
@@ -127,7 +127,7 @@ func VerifyLogin() func(c *fiber.Ctx) error {
 						if Hooks.LoginForm.Has2Auth != nil && Hooks.LoginForm.Render2Auth != nil && Hooks.LoginForm.Verify2Auth != nil && Hooks.LoginForm.Has2Auth(uuid) {
 							formToken := string(crypt.RandBytes(64))
 							formCookie := string(crypt.RandBytes(64))
-							exp := time.Now().Add(2 * time.Hour)
+							exp := clockNow().Add(2 * time.Hour)
 
 							formSession.Set(formToken, formSessionData{
 								pcid: Hooks.GetPCID(c),
@@ -195,7 +195,7 @@ func VerifyLogin() func(c *fiber.Ctx) error {
 			}
 
 			formToken := goutil.Clean.Str(c.FormValue("session"))
-			if session, ok := formSession.Get(formToken); ok && session.pcid == Hooks.GetPCID(c) && time.Now().UnixMilli() < session.exp.UnixMilli() {
+			if session, ok := formSession.Get(formToken); ok && session.pcid == Hooks.GetPCID(c) && clockNow().UnixMilli() < session.exp.UnixMilli() {
 				formSession.Del(formToken)
 				if formCookie := goutil.Clean.Str(c.Cookies("form_session")); formCookie == session.cookie {
 					c.ClearCookie("form_session")
@@ -261,7 +261,7 @@ func VerifyLogin() func(c *fiber.Ctx) error {
 		// send user a login form
 		formToken := string(crypt.RandBytes(64))
 		formCookie := string(crypt.RandBytes(64))
-		exp := time.Now().Add(2 * time.Hour)
+		exp := clockNow().Add(2 * time.Hour)
 
 		formSession.Set(formToken, formSessionData{
 			pcid: Hooks.GetPCID(c),
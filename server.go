@@ -0,0 +1,349 @@
+package webext
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// TLSRetryDelay is how long to wait before retrying a failed https listener
+// (doubled after every failed attempt, up to TLSRetryMaxDelay)
+//
+// default: 1 second
+var TLSRetryDelay time.Duration = 1 * time.Second
+
+// TLSRetryMaxDelay is the max delay between retries of a failed https listener
+//
+// default: 1 minute
+var TLSRetryMaxDelay time.Duration = 1 * time.Minute
+
+// Server is a running ListenAutoTLS server (see StartAutoTLS)
+//
+// it owns the http and https listeners, and the certificate renewal jobs
+type Server struct {
+	app *fiber.App
+
+	listeners []net.Listener
+	jobs []*CronJob
+
+	// errs contains the errors returned by the listeners
+	errs []error
+
+	// tlsErr is the last error of the https listener, while it is down
+	tlsErr error
+
+	// sslPort is the https port of the server (0 if it does not serve https)
+	sslPort uint16
+
+	// stop is closed when the server is shut down
+	stop chan struct{}
+	stopped bool
+
+	mu sync.Mutex
+	wg sync.WaitGroup
+
+	shutdown sync.Once
+	shutdownErr error
+}
+
+// tlsServerKey identifies the https listener of an app
+type tlsServerKey struct {
+	app *fiber.App
+	port uint16
+}
+
+// tlsServers contains the running servers by their app and https port,
+// so RedirectSSL can check if the https listener it redirects to is down
+var tlsServers sync.Map
+
+func init(){
+	if Hooks.OnTLSError == nil {
+		Hooks.OnTLSError = func(err error) {
+			PrintMsg(`error`, "TLS Error: "+err.Error(), 50, true)
+		}
+	}
+}
+
+// newServer returns a Server for @app, without any listeners
+func newServer(app *fiber.App) *Server {
+	return &Server{
+		app: app,
+		stop: make(chan struct{}),
+	}
+}
+
+// register makes the https listener of the server at @sslPort visible to RedirectSSL
+func (srv *Server) register(sslPort uint16) {
+	srv.mu.Lock()
+	srv.sslPort = sslPort
+	srv.mu.Unlock()
+
+	tlsServers.Store(tlsServerKey{app: srv.app, port: sslPort}, srv)
+}
+
+// tlsDown returns true if the https listener of @app at @sslPort is down
+func tlsDown(app *fiber.App, sslPort uint16) bool {
+	srv, ok := tlsServers.Load(tlsServerKey{app: app, port: sslPort})
+	return ok && srv.(*Server).TLSError() != nil
+}
+
+// track adds a listener to be closed by Shutdown
+//
+// returns false if the server is already shutting down
+func (srv *Server) track(ln net.Listener) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.stopped {
+		return false
+	}
+
+	srv.listeners = append(srv.listeners, ln)
+	return true
+}
+
+// isStopped returns true if the server is shutting down
+func (srv *Server) isStopped() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	return srv.stopped
+}
+
+// serve serves the app on @ln, until the server is shut down
+//
+// if the listener stops on its own, the rest of the server is shut down too
+func (srv *Server) serve(ln net.Listener) {
+	if !srv.track(ln) {
+		ln.Close()
+		return
+	}
+
+	srv.wg.Add(1)
+	go func(){
+		defer srv.wg.Done()
+
+		err := srv.app.Listener(ln)
+		if srv.isStopped() {
+			return
+		}
+
+		if err != nil {
+			srv.fail(err)
+		}
+		go srv.Shutdown(context.Background())
+	}()
+}
+
+// servePrefork serves the app at @addr with fiber's own listener, which supports Prefork
+// (fiber does not support Prefork with custom listeners)
+//
+// @cert: serve https with this certificate if not nil
+//
+// if the listener stops on its own, the rest of the server is shut down too
+func (srv *Server) servePrefork(addr string, cert *tls.Certificate) {
+	srv.wg.Add(1)
+	go func(){
+		defer srv.wg.Done()
+
+		var err error
+		if cert != nil {
+			err = srv.app.ListenTLSWithCertificate(addr, *cert)
+		}else{
+			err = srv.app.Listen(addr)
+		}
+
+		if srv.isStopped() {
+			return
+		}
+
+		if err != nil {
+			srv.fail(err)
+		}
+		go srv.Shutdown(context.Background())
+	}()
+}
+
+// serveTLS serves the app on a tls listener at @addr (on the Network of the app config),
+// until the server is shut down
+//
+// if the listener fails, the error is sent to Hooks.OnTLSError,
+// and it is retried with a backoff (see TLSRetryDelay).
+// RedirectSSL stops redirecting to https while the listener is down.
+func (srv *Server) serveTLS(addr string, config *tls.Config) {
+	listen := func() (net.Listener, error) {
+		ln, err := tls.Listen(srv.app.Config().Network, addr, config)
+		if err != nil {
+			return nil, err
+		}
+
+		if !srv.track(ln) {
+			ln.Close()
+			return nil, nil
+		}
+
+		srv.setTLSErr(nil)
+		return ln, nil
+	}
+
+	// the first attempt is made before returning, so https is ready when the http listener starts
+	ln, err := listen()
+	if err != nil {
+		srv.setTLSErr(err)
+	}
+
+	srv.wg.Add(1)
+	go func(){
+		defer srv.wg.Done()
+
+		for attempt := 0; ; attempt++ {
+			if ln != nil {
+				attempt = 0
+
+				err = srv.app.Listener(ln)
+				if err == nil {
+					err = errors.New("tls: listener closed: "+addr)
+				}
+			}
+
+			if srv.isStopped() {
+				return
+			}
+
+			srv.setTLSErr(err)
+			if Hooks.OnTLSError != nil {
+				Hooks.OnTLSError(err)
+			}
+
+			delay := cronRetryDelay(CronOpts{RetryDelay: TLSRetryDelay, RetryMaxDelay: TLSRetryMaxDelay}, attempt)
+
+			timer := time.NewTimer(delay)
+			select {
+			case <-srv.stop:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+
+			ln, err = listen()
+			if ln != nil {
+				PrintMsg(`confirm`, "TLS Listener Recovered!", 50, true)
+			}
+		}
+	}()
+}
+
+// setTLSErr sets the current error of the https listener,
+// or nil once the listener is up again
+func (srv *Server) setTLSErr(err error) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	srv.tlsErr = err
+}
+
+// TLSError returns the last error of the https listener, or nil if it is up
+func (srv *Server) TLSError() error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	return srv.tlsErr
+}
+
+// addJob adds a job that is stopped with the server
+func (srv *Server) addJob(job *CronJob) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	srv.jobs = append(srv.jobs, job)
+}
+
+// fail records an error of a listener
+func (srv *Server) fail(err error) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	srv.errs = append(srv.errs, err)
+}
+
+// err returns the errors of every listener
+func (srv *Server) err() error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	return errors.Join(append(append([]error{}, srv.errs...), srv.tlsErr)...)
+}
+
+// stopJobs stops the certificate renewal jobs
+func (srv *Server) stopJobs() {
+	srv.mu.Lock()
+	jobs := srv.jobs
+	srv.jobs = nil
+	srv.mu.Unlock()
+
+	for _, job := range jobs {
+		job.Stop()
+	}
+}
+
+// Wait blocks until both listeners have stopped, and returns their errors
+//
+// if the https listener fails, it is retried while the http listener keeps running,
+// so Wait only returns once the server is shut down, or the http listener fails.
+func (srv *Server) Wait() error {
+	srv.wg.Wait()
+	srv.stopJobs()
+
+	return srv.err()
+}
+
+// Shutdown gracefully shuts down the server
+//  - stops the certificate renewal jobs
+//  - stops accepting new connections on both listeners
+//  - waits for open connections to finish, until @ctx is done
+//
+// the errors of both listeners are returned, along with any error from shutting down.
+//
+// Note: this shuts down the fiber app, so it also stops any other listeners of the app
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.shutdown.Do(func(){
+		srv.mu.Lock()
+		srv.stopped = true
+		close(srv.stop)
+		sslPort := srv.sslPort
+		srv.mu.Unlock()
+
+		if sslPort != 0 {
+			tlsServers.CompareAndDelete(tlsServerKey{app: srv.app, port: sslPort}, srv)
+		}
+
+		srv.stopJobs()
+
+		srv.shutdownErr = srv.app.ShutdownWithContext(ctx)
+
+		// close listeners that the app did not start serving yet
+		srv.mu.Lock()
+		for _, ln := range srv.listeners {
+			ln.Close()
+		}
+		srv.mu.Unlock()
+	})
+
+	done := make(chan struct{})
+	go func(){
+		srv.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return errors.Join(srv.shutdownErr, srv.err())
+	case <-ctx.Done():
+		return errors.Join(srv.shutdownErr, ctx.Err(), srv.err())
+	}
+}
@@ -1,23 +1,20 @@
 package webext
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/x509"
-	"crypto/x509/pkix"
-	"encoding/pem"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"net"
 	rfs "io/fs"
-	"math/big"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/AspieSoft/go-regex-re2/v2"
-	"github.com/AspieSoft/goutil/fs/v3"
 	"github.com/AspieSoft/goutil/v7"
 	"github.com/gofiber/fiber/v2"
 )
@@ -30,8 +27,6 @@ var PWD string = "."
 // (i.e. if you ran your app with sudo)
 var IsRoot bool = os.Geteuid() == 0
 
-var hasFailedSSL bool
-
 func init(){
 	var err error
 	PWD, err = os.Getwd()
@@ -51,6 +46,11 @@ func init(){
 // @handleErr: optional, allows you to define a function for handling invalid origins, instead of returning the default http error
 func VerifyOrigin(origin []string, proxy []string, handleErr ...func(c *fiber.Ctx, err error) error) func(c *fiber.Ctx) error {
 	return func(c *fiber.Ctx) error {
+		// let the ACME server verify pending challenges (see SetACME)
+		if res, ok := acmeHTTPChallenge(c.Path()); ok {
+			return c.SendString(res)
+		}
+
 		hostname := string(regex.Comp(`:[0-9]+$`).RepStrLit([]byte(goutil.Clean.Str(c.Hostname())), []byte{}))
 		ip := goutil.Clean.Str(c.IP())
 
@@ -95,9 +95,17 @@ func VerifyOrigin(origin []string, proxy []string, handleErr ...func(c *fiber.Ct
 // RedirectSSL can be added to `app.Use` to auto redirect http to https
 //
 // @httpPort: 80, @sslPort: 443
+//
+// while the https listener of ListenAutoTLS at @sslPort is down (see Server.TLSError),
+// http is served without redirecting
 func RedirectSSL(httpPort, sslPort uint16) func(c *fiber.Ctx) error {
 	return func(c *fiber.Ctx) error {
-		if c.Secure() || hasFailedSSL {
+		// ACME challenges must be served over http (see SetACME)
+		if res, ok := acmeHTTPChallenge(c.Path()); ok {
+			return c.SendString(res)
+		}
+
+		if c.Secure() || tlsDown(c.App(), sslPort) {
 			return c.Next()
 		}
 
@@ -124,43 +132,168 @@ func RedirectSSL(httpPort, sslPort uint16) func(c *fiber.Ctx) error {
 // ListenAutoTLS will automatically generate a self signed tls certificate
 // if needed and listen to both http and https ports
 //
+// if ACME is enabled (see SetACME), the certificate is issued by the ACME server instead,
+// and the self signed certificate is only used as a fallback if that fails
+//
+// if you provide your own certificates (see SetCertFiles), they are served while they are valid,
+// and the generated certificate is only used as a fallback
+//
+// each domain set by SetCertDomains gets its own certificate, selected by the server name of the connection
+//
 // @httpPort: 80, @sslPort: 443
 //
 // @certPath: file path to store ssl certificates to (this will generate a my/path.crt and my/path.key file)
 //
 // @proxy: optional, if only one proxy is specified, the app will only listen to that ip address
+//
+// ListenAutoTLS blocks until both listeners stop.
+// Use StartAutoTLS to get a Server you can shut down.
 func ListenAutoTLS(app *fiber.App, httpPort, sslPort uint16, certPath string, proxy ...[]string) error {
+	srv, err := StartAutoTLS(app, httpPort, sslPort, certPath, proxy...)
+	if err != nil {
+		return err
+	}
+
+	return srv.Wait()
+}
+
+// StartAutoTLS is the same as ListenAutoTLS, but returns once both ports are listening
+//
+// the returned Server owns both listeners and the certificate renewal jobs,
+// and can be stopped with Shutdown
+//
+//  srv, err := webext.StartAutoTLS(app, 8080, 8443, "db/ssl/auto_ssl")
+//  if err != nil {
+//    panic(err)
+//  }
+//
+//  <-ctx.Done()
+//  srv.Shutdown(context.Background())
+//
+// Note: if Prefork is enabled (see fiber.Config), both ports are served by fiber's own listeners,
+// since fiber does not support Prefork with custom listeners.
+// The certificate is then only loaded when the server starts (a renewed certificate is served after a restart),
+// SetCertDomains is ignored, and a failed https listener is not retried.
+func StartAutoTLS(app *fiber.App, httpPort, sslPort uint16, certPath string, proxy ...[]string) (*Server, error) {
 	certPath = string(regex.Comp(`\.(crt|key)$`).RepStrLit([]byte(certPath), []byte{}))
 
+	srv := newServer(app)
+
 	if sslPort != 0 && certPath != "" {
 		port := ":"+strconv.Itoa(int(sslPort))
 		if len(proxy) == 1 && len(proxy[0]) == 1 {
 			port = proxy[0][0] + port
 		}
 
-		// generate ssl cert if needed
+		acmeOpts := getACME()
+
 		os.MkdirAll(filepath.Dir(certPath), TryPerm(0644, 0755))
-		err := GenRsaKeyIfNeeded(certPath+".crt", certPath+".key")
-		if err != nil {
-			return err
-		}
 
-		// auto renew ssl cert if expired
-		NewCron(24 * time.Hour, func() bool {
-			err := GenRsaKeyIfNeeded(certPath+".crt", certPath+".key")
+		crtPath, keyPath := certPath+".crt", certPath+".key"
+
+		// use your own cert if it is valid (see SetCertFiles), or
+		// generate ssl cert if needed
+		// (with ACME, a self signed cert is used until the ACME certificate is issued,
+		// which happens after the listeners start, so the ACME server can verify the challenges)
+		files := userCertFiles()
+		if len(files) != 0 {
+			crtPath, keyPath = files[0].CrtPath, files[0].KeyPath
+		}else{
+			var err error
+			if acmeOpts == nil {
+				err = GenRsaKeyIfNeeded(crtPath, keyPath)
+			}else{
+				err = genRsaKeyIfExpired(crtPath, keyPath)
+			}
 			if err != nil {
-				fmt.Println(err)
-				return false
+				return nil, err
+			}
+		}
+
+		// the listener selects a cert by domain (see SetCertDomains), and
+		// picks up renewed certs without restarting
+		cert := NewCertStore()
+		if err := cert.SetDefault(crtPath, keyPath); err != nil {
+			return nil, err
+		}
+		if err := refreshAutoTLS(cert, certPath, files, acmeOpts); err != nil {
+			return nil, err
+		}
+
+		tlsConfig := &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			NextProtos: []string{"http/1.1"},
+			GetCertificate: cert.GetCertificate,
+		}
+
+		if acmeOpts != nil {
+			acmeTLSConfig(tlsConfig)
+
+			// serve http-01 challenges on the http port, for apps that do not use
+			// VerifyOrigin or RedirectSSL (which serve them before any of your routes)
+			if _, loaded := acmeApps.LoadOrStore(app, true); !loaded {
+				app.Use(func(c *fiber.Ctx) error {
+					if res, ok := acmeHTTPChallenge(c.Path()); ok {
+						return c.SendString(res)
+					}
+					return c.Next()
+				})
+			}
+		}
+
+		// auto renew ssl cert if expired, and switch between your own cert and the generated cert
+		// (errors are sent to Hooks.OnCronError, and retried with a backoff)
+		renew := NewCronCtx(24 * time.Hour, func(ctx context.Context) error {
+			files := userCertFiles()
+
+			var err error
+			if len(files) != 0 {
+				err = cert.SetDefault(files[0].CrtPath, files[0].KeyPath)
+			}else{
+				if acmeOpts == nil {
+					err = GenRsaKeyIfNeeded(certPath+".crt", certPath+".key")
+				}else{
+					err = renewACME(ctx, acmeOpts, certPath+".crt", certPath+".key")
+				}
+
+				if e := cert.SetDefault(certPath+".crt", certPath+".key"); e != nil && err == nil {
+					err = e
+				}
+			}
+
+			return errors.Join(err, refreshAutoTLS(cert, certPath, files, acmeOpts))
+		}, CronOpts{Retries: 8, RetryDelay: 1 * time.Minute})
+		srv.addJob(renew)
+
+		// remove old certificates from the history (see CertHistoryLimit)
+		prune := NewCronCtx(24 * time.Hour, func(ctx context.Context) error {
+			var errs []error
+			for _, path := range autoTLSCertPaths(certPath) {
+				errs = append(errs, PruneCertHistory(path))
 			}
-			return true
+			return errors.Join(errs...)
 		})
+		srv.addJob(prune)
 
-		go func(){
-			err := app.ListenTLS(port, certPath+".crt", certPath+".key")
+		// RedirectSSL stops redirecting to this port while the listener is down
+		srv.register(sslPort)
+
+		if app.Config().Prefork {
+			crt, err := cert.GetCertificate(&tls.ClientHelloInfo{})
 			if err != nil {
-				hasFailedSSL = true
+				srv.Shutdown(context.Background())
+				return nil, err
 			}
-		}()
+			srv.servePrefork(port, crt)
+		}else{
+			// if the listener fails, keep serving http, and retry with a backoff
+			srv.serveTLS(port, tlsConfig)
+		}
+
+		// issue the ACME certificate now
+		if acmeOpts != nil {
+			renew.RunNow()
+		}
 	}
 	
 	port := ":"+strconv.Itoa(int(httpPort))
@@ -168,11 +301,24 @@ func ListenAutoTLS(app *fiber.App, httpPort, sslPort uint16, certPath string, pr
 		port = proxy[0][0] + port
 	}
 
-	return app.Listen(port)
+	if app.Config().Prefork {
+		srv.servePrefork(port, nil)
+		return srv, nil
+	}
+
+	ln, err := net.Listen(app.Config().Network, port)
+	if err != nil {
+		srv.Shutdown(context.Background())
+		return nil, err
+	}
+	srv.serve(ln)
+
+	return srv, nil
 }
 
 
 var failedPermList []rfs.FileMode = []rfs.FileMode{}
+var failedPermMU sync.Mutex
 
 // TryPerm attempts to set a directory permission to @perm only if it can access that directory
 //
@@ -183,6 +329,10 @@ func TryPerm(perm rfs.FileMode, nonrootPerm rfs.FileMode) rfs.FileMode {
 		return perm
 	}
 
+	// the test directory is shared, so only one permission is tested at a time
+	failedPermMU.Lock()
+	defer failedPermMU.Unlock()
+
 	if goutil.Contains(failedPermList, perm) {
 		return nonrootPerm
 	}
@@ -202,49 +352,70 @@ func TryPerm(perm rfs.FileMode, nonrootPerm rfs.FileMode) rfs.FileMode {
 	return perm
 }
 
-// GenRsaKeyIfNeeded auto detects if the certificates generated by
-// the GenRsaKey method are either
+// GenRsaKeyIfNeeded auto detects if the certificate at @crtPath either
+//  - expires within CertRenewBefore (default: 30 days)
+//  - does not match the key at @keyPath
+// If it detects this is true, it will automatically regenerate a new certificate
+//
+// if the certificate cannot be parsed, it falls back to detecting if the
+// certificates generated by the GenRsaKey method are either
 //  - not synchronized by date modified
 //  - are possibly expired (assuming a 1 year renewal)
-// If it detects this is true, it will automatically regenerate a new certificate
 func GenRsaKeyIfNeeded(crtPath string, keyPath string) error {
+	return genCertIfNeeded(CertOptions{
+		CrtPath: crtPath,
+		KeyPath: keyPath,
+	})
+}
+
+// genCertIfNeeded is the same as GenRsaKeyIfNeeded, but generates the certificate with @opts
+//
+// the check and renewal run while holding the lock of the certificate,
+// so only one instance renews a certificate that is shared by multiple instances
+func genCertIfNeeded(opts CertOptions) error {
+	unlock, err := lockCertFiles(opts.CrtPath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	crtPath, keyPath := opts.CrtPath, opts.KeyPath
+
 	crtStat, crtErr := os.Stat(crtPath)
 	keyStat, keyErr := os.Stat(keyPath)
 
 	if crtErr != nil || keyErr != nil {
-		err := GenRsaKey(crtPath, keyPath)
+		err := genCert(opts)
 		if err != nil {
 			return err
 		}
 		return nil
 	}
 
-	crtTime := crtStat.ModTime()
-	keyTime := keyStat.ModTime()
+	renew, parsed, err := certNeedsRenewal(crtPath, keyPath)
+	if err != nil {
+		return err
+	}else if !parsed {
+		crtTime := crtStat.ModTime()
+		keyTime := keyStat.ModTime()
 
-	// regenerate if cert and key not synced || its been 1 year
-	if crtTime.UnixMilli() / 60000 != keyTime.UnixMilli() / 60000 || time.Now().Year() > crtTime.Year() {
-		_, err := fs.Copy(crtPath, crtPath+".old")
-		if err != nil {
-			os.Remove(crtPath+".old")
-			return err
-		}
+		// regenerate if cert and key not synced || its been 1 year
+		renew = crtTime.UnixMilli() / 60000 != keyTime.UnixMilli() / 60000 || clockNow().Year() > crtTime.Year()
+	}
 
-		_, err = fs.Copy(keyPath, keyPath+".old")
+	if renew {
+		// keep the current pair, so it can be restored (see RollbackCert)
+		entry, err := saveCertHistory(crtPath, keyPath)
 		if err != nil {
-			os.Remove(crtPath+".old")
-			os.Remove(keyPath+".old")
 			return err
 		}
 
-		err = GenRsaKey(crtPath, keyPath)
+		err = genCert(opts)
 		if err != nil {
-			if _, e := fs.Copy(crtPath+".old", crtPath); e == nil {
-				os.Remove(crtPath+".old")
-			}
-
-			if _, e := fs.Copy(keyPath+".old", keyPath); e == nil {
-				os.Remove(keyPath+".old")
+			if crt, e := os.ReadFile(entry.CrtPath); e == nil {
+				if key, e := os.ReadFile(entry.KeyPath); e == nil {
+					writeCertFiles(crtPath, keyPath, crt, key)
+				}
 			}
 
 			return err
@@ -254,79 +425,70 @@ func GenRsaKeyIfNeeded(crtPath string, keyPath string) error {
 	return nil
 }
 
+// genRsaKeyIfExpired generates a new self signed certificate only if
+// the current certificate is missing, invalid, or expired
+//
+// unlike GenRsaKeyIfNeeded, this keeps certificates that are about to expire,
+// so a valid ACME certificate is not replaced while the ACME server is down
+func genRsaKeyIfExpired(crtPath string, keyPath string) error {
+	return withCertLock(crtPath, func() error {
+		if err := checkKeyPassphrase(keyPath); err != nil {
+			return err
+		}
+
+		if leaf, err := loadCertLeaf(crtPath, keyPath); err == nil && clockNow().Before(leaf.NotAfter) {
+			return nil
+		}
+
+		// keep the current pair, so it can be restored (see RollbackCert)
+		if err := keepCertHistory(crtPath, keyPath); err != nil {
+			return err
+		}
+
+		return genCert(CertOptions{
+			CrtPath: crtPath,
+			KeyPath: keyPath,
+		})
+	})
+}
+
 // GenRsaKey generates a new ssl certificate and key pair
 //  - expires: 3 years
 //  - rsa: 4096
 //  - x509
 //  - sha256
+//  - valid for: localhost, 127.0.0.1, ::1
 //  - recommended renewal: once a year
+//
+// use GenCert to change any of these settings
+//
+// if a local certificate authority is enabled (see SetLocalCA), the certificate is
+// signed by that certificate authority instead, and expires after LocalCAOpts.LeafValidity
 func GenRsaKey(crtPath string, keyPath string) error {
 	//// 10 years: openssl req -newkey rsa:4096 -x509 -sha256 -days 3650 -nodes -out example.crt -keyout example.key
 	// 3 years: openssl req -newkey rsa:4096 -x509 -sha256 -days 1095 -nodes -out example.crt -keyout example.key
 
-	PrintMsg(`warn`, "Generating New SSL Certificate...", 50, false)
-
-	// Generate RSA key
-	key, err := rsa.GenerateKey(rand.Reader, 4096)
-	if err != nil {
-		PrintMsg(`error`, "Error: Failed To Generate SSL Certificate!", 50, true)
-		return err
-	}
-
-	keyBytes := x509.MarshalPKCS1PrivateKey(key)
-	// PEM encoding of private key
-	keyPEM := pem.EncodeToMemory(
-		&pem.Block{
-			Type:  "RSA PRIVATE KEY",
-			Bytes: keyBytes,
-		},
-	)
-
-	notBefore := time.Now()
-	notAfter := notBefore.Add(365*24*3*time.Hour)
-
-	// Create certificate template
-	template := x509.Certificate{
-		SerialNumber:          big.NewInt(0),
-		Subject:               pkix.Name{CommonName: "localhost"},
-		SignatureAlgorithm:    x509.SHA256WithRSA,
-		NotBefore:             notBefore,
-		NotAfter:              notAfter,
-		BasicConstraintsValid: true,
-		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyAgreement | x509.KeyUsageKeyEncipherment | x509.KeyUsageDataEncipherment,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
-	}
+	return withCertLock(crtPath, func() error {
+		return genCert(CertOptions{
+			CrtPath: crtPath,
+			KeyPath: keyPath,
+		})
+	})
+}
 
-	// Create certificate using template
-	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+// genCert generates a new certificate with @opts, signed by the
+// local certificate authority if it is enabled (see SetLocalCA)
+//
+// Note: the caller should hold the lock of the certificate (see lockCertFiles)
+func genCert(opts CertOptions) error {
+	ca, err := getLocalCA(opts.CrtPath)
 	if err != nil {
-		PrintMsg(`error`, "Error: Failed To Generate SSL Certificate!", 50, true)
-		return err
-	}
-
-	// pem encoding of certificate
-	certPem := pem.EncodeToMemory(
-		&pem.Block{
-			Type:  "CERTIFICATE",
-			Bytes: derBytes,
-		},
-	)
-
-	// Write key to file
-	if err := os.WriteFile(crtPath, certPem, 0600); err != nil {
-		PrintMsg(`error`, "Error: Failed To Generate SSL Certificate!", 50, true)
-		return err
-	}
-
-	// Write cert to file
-	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
-		PrintMsg(`error`, "Error: Failed To Generate SSL Certificate!", 50, true)
 		return err
+	}else if ca != nil {
+		return ca.issue(opts)
 	}
 
-	PrintMsg(`warn`, "New SSL Certificate Generated!", 50, true)
-
-	return nil
+	return genSelfSignedCert(opts)
 }
 
 // PrintMsg prints to console and auto inserts spaces